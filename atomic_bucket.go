@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AtomicTokenBucket 是无锁的令牌桶实现，用于不需要存储后端的限速器（单次传输、
+// 内存模式下的用户、用户组和全局限速）。
+//
+// 状态使用GCRA算法表示为一个原子的理论到达时间（TAT，Unix纳秒）：
+// 每发送一个字节TAT向后推进1/rate秒，TAT超出当前时间的部分即为欠下的令牌。
+// 所有操作通过CAS完成，高并发下不会在互斥锁上排队。
+//
+// TAT的含义依赖于速率和突发容量，三者必须成对读取。修改速率或突发容量时seq先变为奇数，
+// 按旧配置换算TAT并写入新配置后再变回偶数；其他操作只使用seq为偶数且
+// 前后不变时读到的配置和TAT，修改期间让出CPU等待修改完成。
+// 修改配置很少发生，因此只有SetRate、SetBurst之间使用互斥锁。
+type AtomicTokenBucket struct {
+	tat             atomic.Int64  // 理论到达时间
+	rate            atomic.Int64  // 令牌生成速率（字节/秒）
+	burst           atomic.Int64  // 突发容量（字节），大于0时代替突发倍数
+	seq             atomic.Uint64 // 配置修改序号，奇数表示正在修改
+	rateMutex       sync.Mutex    // 串行化SetRate和SetBurst
+	burstMultiplier float64       // 突发倍数
+}
+
+// NewAtomicTokenBucket 创建新的无锁令牌桶，初始令牌数为0
+func NewAtomicTokenBucket(rate int64, burstMultiplier float64) *AtomicTokenBucket {
+	tb := &AtomicTokenBucket{
+		burstMultiplier: burstMultiplier,
+	}
+	tb.rate.Store(rate)
+	// 初始令牌数为0，避免突发流量
+	tb.tat.Store(time.Now().UnixNano() + tb.tolerance(rate, 0))
+	return tb
+}
+
+// effectiveRate 返回用于计算的速率，速率无效时默认1KB/s
+func effectiveRate(rate int64) int64 {
+	if rate <= 0 {
+		return 1024
+	}
+	return rate
+}
+
+// interval 返回以指定速率发送count字节所需的纳秒数
+func interval(count, rate int64) int64 {
+	return int64(float64(count) / float64(effectiveRate(rate)) * float64(time.Second))
+}
+
+// snapshot 返回一致的速率、突发容量和TAT
+func (tb *AtomicTokenBucket) snapshot() (rate, burst, tat int64) {
+	for {
+		seq := tb.seq.Load()
+		if seq&1 == 0 {
+			rate, burst, tat = tb.rate.Load(), tb.burst.Load(), tb.tat.Load()
+			if tb.seq.Load() == seq {
+				return rate, burst, tat
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+// capacity 返回突发容量，burst为0时使用突发倍数
+func (tb *AtomicTokenBucket) capacity(rate, burst int64) int64 {
+	if burst > 0 {
+		return burst
+	}
+	return int64(float64(rate) * tb.burstMultiplier)
+}
+
+// tolerance 返回突发容量对应的纳秒数，即TAT最多可以领先当前时间多久
+func (tb *AtomicTokenBucket) tolerance(rate, burst int64) int64 {
+	return interval(tb.capacity(rate, burst), rate)
+}
+
+// Allow 检查是否允许消耗指定数量的令牌，允许时立即消耗
+func (tb *AtomicTokenBucket) Allow(count int64) bool {
+	for {
+		// 读取之后SetRate换算TAT时，下面的CAS会失败并重新读取；
+		// 先于SetRate完成的CAS则由SetRate按旧速率换算
+		rate, burst, tat := tb.snapshot()
+		now := time.Now().UnixNano()
+
+		newTat := max(tat, now) + interval(count, rate)
+		if newTat-now > tb.tolerance(rate, burst) {
+			return false
+		}
+		if tb.tat.CompareAndSwap(tat, newTat) {
+			return true
+		}
+	}
+}
+
+// Consume 强制消耗指定数量的令牌，负数表示归还。欠债不超过一个突发容量，
+// 归还后的令牌数不超过突发容量
+func (tb *AtomicTokenBucket) Consume(count int64) {
+	for {
+		rate, burst, tat := tb.snapshot()
+		now := time.Now().UnixNano()
+
+		newTat := max(tat, now) + interval(count, rate)
+		newTat = min(max(newTat, now), now+2*tb.tolerance(rate, burst))
+		if tb.tat.CompareAndSwap(tat, newTat) {
+			return
+		}
+	}
+}
+
+// Delay 返回获得指定数量令牌还需等待的时间，令牌充足时返回0
+func (tb *AtomicTokenBucket) Delay(count int64) time.Duration {
+	rate, burst, tat := tb.snapshot()
+	now := time.Now().UnixNano()
+	newTat := max(tat, now) + interval(count, rate)
+	if wait := newTat - now - tb.tolerance(rate, burst); wait > 0 {
+		return time.Duration(wait)
+	}
+	return 0
+}
+
+// Rate 获取令牌桶的速率
+func (tb *AtomicTokenBucket) Rate() int64 {
+	return tb.rate.Load()
+}
+
+// SetRate 设置令牌桶的速率，按新速率换算当前欠下的令牌。
+// 换算期间其他操作等待，不会读到新的TAT和旧的速率
+func (tb *AtomicTokenBucket) SetRate(rate int64) {
+	tb.rateMutex.Lock()
+	defer tb.rateMutex.Unlock()
+
+	oldRate := tb.rate.Load()
+	if oldRate == rate {
+		return
+	}
+
+	tb.reconfigure(func(tat, now int64) int64 {
+		if tat <= now {
+			return now
+		}
+		debt := float64(tat-now) / float64(time.Second) * float64(effectiveRate(oldRate))
+		return now + interval(int64(debt), rate)
+	}, func() {
+		tb.rate.Store(rate)
+	})
+}
+
+// Burst 返回令牌桶的最大令牌数
+func (tb *AtomicTokenBucket) Burst() int64 {
+	rate, burst, _ := tb.snapshot()
+	return tb.capacity(rate, burst)
+}
+
+// SetBurst 设置令牌桶的突发容量（字节），0表示使用突发倍数。
+// 与TokenBucket一致，当前令牌数保持不变，只在超过新的突发容量时截断
+func (tb *AtomicTokenBucket) SetBurst(burst int64) {
+	tb.rateMutex.Lock()
+	defer tb.rateMutex.Unlock()
+
+	oldBurst := tb.burst.Load()
+	if oldBurst == burst {
+		return
+	}
+
+	rate := tb.rate.Load()
+	grow := interval(tb.capacity(rate, burst)-tb.capacity(rate, oldBurst), rate)
+	tb.reconfigure(func(tat, now int64) int64 {
+		return max(max(tat, now)+grow, now)
+	}, func() {
+		tb.burst.Store(burst)
+	})
+}
+
+// reconfigure 在seq为奇数期间用convert按旧配置换算TAT，再用apply写入新配置。
+// 调用者必须持有rateMutex
+func (tb *AtomicTokenBucket) reconfigure(convert func(tat, now int64) int64, apply func()) {
+	tb.seq.Add(1)
+	for {
+		now := time.Now().UnixNano()
+		tat := tb.tat.Load()
+		// 与seq变为奇数之前读取的Allow、Consume竞争，失败时按它们更新后的TAT重新换算
+		if tb.tat.CompareAndSwap(tat, convert(tat, now)) {
+			break
+		}
+	}
+	apply()
+	tb.seq.Add(1)
+}
+
+// Idle 返回令牌桶回满后经过的时间，可以近似看作最近一次消耗令牌之后的空闲时间。
+// 仍有欠债时返回负数
+func (tb *AtomicTokenBucket) Idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - tb.tat.Load())
+}
+
+// LastAccess 返回令牌桶回满的时间，用于注册表按空闲时间清理。
+// 仍有欠债时晚于当前时间，因此正在使用的令牌桶不会被清理
+func (tb *AtomicTokenBucket) LastAccess() time.Time {
+	return time.Unix(0, tb.tat.Load())
+}
+
+// Tokens 获取当前可用令牌数，欠债时为负数
+func (tb *AtomicTokenBucket) Tokens() float64 {
+	rate, burst, tat := tb.snapshot()
+	now := time.Now().UnixNano()
+	ahead := max(tat, now) - now
+	return float64(tb.tolerance(rate, burst)-ahead) / float64(time.Second) * float64(effectiveRate(rate))
+}
+
+// Interface guards
+var (
+	_ SharedLimiter = (*AtomicTokenBucket)(nil)
+)
@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAtomicBucketSetRateConvertsDebt(t *testing.T) {
+	// 初始令牌数为0，欠下一个突发容量（1000字节）
+	tb := NewAtomicTokenBucket(1000, 1)
+	tb.SetRate(2000)
+
+	// 按新速率换算后欠债仍为1000字节，突发容量变为2000字节
+	if tokens := tb.Tokens(); math.Abs(tokens-1000) > 50 {
+		t.Fatalf("Tokens = %.0f, 期望约1000", tokens)
+	}
+	if d := tb.Delay(2000); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("Delay(2000) = %v, 期望约500ms", d)
+	}
+}
+
+func TestAtomicBucketSetBurstKeepsTokens(t *testing.T) {
+	tb := NewAtomicTokenBucket(1000, 1)
+	tb.Consume(-500)
+
+	// 与TokenBucket一致，扩大突发容量不会立即产生令牌
+	tb.SetBurst(4000)
+	if burst := tb.Burst(); burst != 4000 {
+		t.Fatalf("Burst = %d, 期望4000", burst)
+	}
+	if tokens := tb.Tokens(); math.Abs(tokens-500) > 50 {
+		t.Fatalf("扩大突发容量后 Tokens = %.0f, 期望约500", tokens)
+	}
+
+	// 缩小突发容量时超出的令牌被截断
+	tb.SetBurst(200)
+	if tokens := tb.Tokens(); math.Abs(tokens-200) > 1 {
+		t.Fatalf("缩小突发容量后 Tokens = %.0f, 期望200", tokens)
+	}
+	if !tb.Allow(200) || tb.Allow(100) {
+		t.Fatal("缩小突发容量后可以消耗的令牌数不正确")
+	}
+
+	// 0恢复为突发倍数
+	tb.SetBurst(0)
+	if burst := tb.Burst(); burst != 1000 {
+		t.Fatalf("Burst = %d, 期望1000", burst)
+	}
+}
+
+func TestAtomicBucketLastAccess(t *testing.T) {
+	tb := NewAtomicTokenBucket(1000, 1)
+	// 初始欠下一个突发容量，回满之前不算空闲
+	if !tb.LastAccess().After(time.Now()) {
+		t.Fatalf("LastAccess = %v, 新令牌桶应晚于当前时间", tb.LastAccess())
+	}
+
+	tb.Consume(-1000)
+	if idle := time.Since(tb.LastAccess()); idle < 0 || idle > 50*time.Millisecond {
+		t.Fatalf("回满后 time.Since(LastAccess) = %v, 期望约0", idle)
+	}
+}
+
+func TestAtomicBucketWaitsForRateChange(t *testing.T) {
+	tb := NewAtomicTokenBucket(1<<30, 1)
+	tb.Consume(-(1 << 30))
+
+	// 模拟SetRate换算到一半：期间的Allow不能使用尚未配对的速率和TAT
+	tb.seq.Add(1)
+	done := make(chan bool)
+	go func() { done <- tb.Allow(1) }()
+
+	select {
+	case <-done:
+		t.Fatal("速率修改期间Allow没有等待")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	tb.seq.Add(1)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("速率修改完成后Allow失败")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("速率修改完成后Allow仍在等待")
+	}
+}
+
+func TestAtomicBucketConcurrentSetRate(t *testing.T) {
+	const (
+		low      = 1 << 20
+		high     = 2 << 20
+		workers  = 8
+		duration = 200 * time.Millisecond
+	)
+	tb := NewAtomicTokenBucket(low, 1)
+
+	var (
+		admitted atomic.Int64
+		setRates atomic.Int64
+		wg       sync.WaitGroup
+	)
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if tb.Allow(1024) {
+					admitted.Add(1024)
+				}
+				// 模拟写入出错时归还令牌
+				if i == 0 {
+					tb.Consume(-512)
+					admitted.Add(-512)
+				}
+				tb.Delay(1024)
+				tb.Tokens()
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for rate := int64(high); time.Now().Before(deadline); rate = low + high - rate {
+			tb.SetRate(rate)
+			setRates.Add(1)
+		}
+	}()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if setRates.Load() == 0 {
+		t.Fatal("SetRate在竞争下没有完成")
+	}
+	// 速率在两个值之间切换，发送量不能超过按较高速率计算的上限加一个突发容量
+	if limit := int64(elapsed.Seconds()*high) + high; admitted.Load() > limit {
+		t.Fatalf("发送了 %d 字节，超过上限 %d", admitted.Load(), limit)
+	}
+	if tokens := tb.Tokens(); tokens > float64(tb.Burst()) {
+		t.Fatalf("令牌数 %.0f 超过突发容量 %d", tokens, tb.Burst())
+	}
+}
+
+// BenchmarkBucketContention 比较无锁令牌桶和互斥锁令牌桶在高并发下的开销，
+// setrate子测试中同时有一个goroutine不断修改速率
+func BenchmarkBucketContention(b *testing.B) {
+	buckets := map[string]func() Limiter{
+		"atomic": func() Limiter { return NewAtomicTokenBucket(1<<40, 1) },
+		"mutex":  func() Limiter { return NewTokenBucket(1<<40, nil, "bench", zap.NewNop(), 1) },
+	}
+	for _, setRate := range []bool{false, true} {
+		for _, name := range []string{"atomic", "mutex"} {
+			b.Run(fmt.Sprintf("%s/setrate=%v", name, setRate), func(b *testing.B) {
+				bucket := buckets[name]()
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				if setRate {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						setter := bucket.(interface{ SetRate(int64) })
+						for rate := int64(1 << 40); ; rate ^= 1 {
+							select {
+							case <-stop:
+								return
+							default:
+								setter.SetRate(rate)
+							}
+						}
+					}()
+				}
+
+				b.SetParallelism(16)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if !bucket.Allow(1) {
+							bucket.Delay(1)
+						}
+					}
+				})
+				b.StopTimer()
+				close(stop)
+				wg.Wait()
+			})
+		}
+	}
+}
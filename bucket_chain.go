@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Limiter 定义限速写入器可以消费的限速器
+type Limiter interface {
+	// Allow 检查是否允许消耗指定数量的令牌，允许时立即消耗
+	Allow(count int64) bool
+
+	// Consume 强制消耗指定数量的令牌，负数表示归还
+	Consume(count int64)
+
+	// Delay 返回获得指定数量令牌还需等待的时间
+	Delay(count int64) time.Duration
+
+	// Rate 返回限速器的速率（字节/秒）
+	Rate() int64
+
+	// Burst 返回一次最多可以消耗的令牌数
+	Burst() int64
+}
+
+// SharedLimiter 是注册表中由多个请求共享的限速器（用户、用户组等），
+// 可以随后端响应头调整速率和突发容量，并按最后访问时间清理
+type SharedLimiter interface {
+	Limiter
+
+	// SetRate 设置速率（字节/秒）
+	SetRate(rate int64)
+
+	// SetBurst 设置突发容量（字节），0表示使用突发倍数
+	SetBurst(burst int64)
+
+	// LastAccess 返回最后访问时间
+	LastAccess() time.Time
+}
+
+// 令牌桶链中的限速层级，按从细到粗的顺序排列
+const (
+	ScopeTransfer = "transfer" // 单次传输
+	ScopeUser     = "user"     // 用户
+	ScopeGroup    = "group"    // 用户组（如组织ID）
+	ScopeGlobal   = "global"   // 当前站点的全局限速
+)
+
+// chainLink 是令牌桶链中的一个节点
+type chainLink struct {
+	scope   string
+	limiter Limiter
+}
+
+// BucketChain 将多个层级的限速器串联起来，一次传输同时从所有层级消耗令牌，
+// 实际速率由最严格的一级决定
+type BucketChain struct {
+	links []chainLink
+}
+
+// NewBucketChain 创建一个空的令牌桶链
+func NewBucketChain() *BucketChain {
+	return &BucketChain{}
+}
+
+// Add 向链尾追加一个层级的限速器
+func (bc *BucketChain) Add(scope string, limiter Limiter) {
+	bc.links = append(bc.links, chainLink{scope: scope, limiter: limiter})
+}
+
+// Prepend 在链首插入一个层级的限速器
+func (bc *BucketChain) Prepend(scope string, limiter Limiter) {
+	bc.links = append([]chainLink{{scope: scope, limiter: limiter}}, bc.links...)
+}
+
+// Len 返回链中限速器的数量
+func (bc *BucketChain) Len() int {
+	return len(bc.links)
+}
+
+// Limiter 返回指定层级的限速器，不存在时返回nil
+func (bc *BucketChain) Limiter(scope string) Limiter {
+	for _, link := range bc.links {
+		if link.scope == scope {
+			return link.limiter
+		}
+	}
+	return nil
+}
+
+// Scopes 返回链中所有层级的名称
+func (bc *BucketChain) Scopes() []string {
+	scopes := make([]string, 0, len(bc.links))
+	for _, link := range bc.links {
+		scopes = append(scopes, link.scope)
+	}
+	return scopes
+}
+
+// Allow 仅当所有层级都有足够令牌时才消耗令牌。
+// 如果某一层级拒绝，已经消耗的令牌会归还给前面的层级。
+func (bc *BucketChain) Allow(count int64) bool {
+	for i, link := range bc.links {
+		if !link.limiter.Allow(count) {
+			for _, prev := range bc.links[:i] {
+				prev.limiter.Consume(-count)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Consume 在所有层级上强制消耗令牌
+func (bc *BucketChain) Consume(count int64) {
+	for _, link := range bc.links {
+		link.limiter.Consume(count)
+	}
+}
+
+// Delay 返回所有层级中最长的等待时间
+func (bc *BucketChain) Delay(count int64) time.Duration {
+	var delay time.Duration
+	for _, link := range bc.links {
+		if d := link.limiter.Delay(count); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Rate 返回所有层级中最低的速率，即链的有效速率
+func (bc *BucketChain) Rate() int64 {
+	var rate int64
+	for _, link := range bc.links {
+		r := link.limiter.Rate()
+		if r > 0 && (rate == 0 || r < rate) {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// Burst 返回所有层级中最小的突发容量，超过该值的块永远无法获得足够令牌
+func (bc *BucketChain) Burst() int64 {
+	var burst int64
+	for i, link := range bc.links {
+		if b := link.limiter.Burst(); i == 0 || b < burst {
+			burst = b
+		}
+	}
+	return burst
+}
+
+// Interface guards
+var (
+	_ SharedLimiter = (*TokenBucket)(nil)
+	_ Limiter       = (*BucketChain)(nil)
+)
@@ -3,7 +3,9 @@ package ratelimit
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -27,36 +29,8 @@ func (rl *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		// 进入块解析
 		for d.NextBlock(0) {
-			switch d.Val() {
-			case "header_user_id":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				rl.HeaderUserID = d.Val()
-			case "header_rate_limit":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				rl.HeaderRateLimit = d.Val()
-			case "burst_multiplier":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				multiplier, err := strconv.ParseFloat(d.Val(), 64)
-				if err != nil {
-					return fmt.Errorf("无效的突发倍数: %v", err)
-				}
-				if multiplier <= 0 {
-					return fmt.Errorf("突发倍数必须大于0")
-				}
-				rl.BurstMultiplier = multiplier
-			case "redis":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				rl.Redis = d.Val()
-			default:
-				return d.Errf("未知的子指令 '%s'", d.Val())
+			if err := rl.unmarshalOption(d); err != nil {
+				return err
 			}
 		}
 		// 解析完块后退出外层循环
@@ -65,3 +39,354 @@ func (rl *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	return nil
 }
+
+// unmarshalOption 解析一个子指令，rate_limit_dynamic和x_accel共用
+func (rl *RateLimit) unmarshalOption(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "header_user_id":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderUserID = d.Val()
+	case "header_rate_limit":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderRateLimit = d.Val()
+	case "header_group_id":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderGroupID = d.Val()
+	case "header_group_rate_limit":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderGroupRateLimit = d.Val()
+	case "header_rate_limit_ceil":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderRateLimitCeil = d.Val()
+	case "header_group_rate_limit_ceil":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderGroupRateLimitCeil = d.Val()
+	case "header_peak_rate_limit":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderPeakRateLimit = d.Val()
+	case "header_peak_burst":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderPeakBurst = d.Val()
+	case "header_committed_burst":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderCommittedBurst = d.Val()
+	case "header_limit_rate_after":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderLimitRateAfter = d.Val()
+	case "header_transfer_rate_limit":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderTransferRateLimit = d.Val()
+	case "header_limit_rate":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderLimitRate = d.Val()
+	case "header_buffering":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderBuffering = d.Val()
+	case "header_expires":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderExpires = d.Val()
+	case "header_charset":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.HeaderCharset = d.Val()
+	case "global_rate_limit":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rate, err := strconv.ParseInt(d.Val(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("无效的全局限速值: %v", err)
+		}
+		if rate < 0 {
+			return fmt.Errorf("全局限速值不能为负数")
+		}
+		rl.GlobalRateLimit = rate
+	case "peak_rate_limit":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.PeakRateLimit = size
+	case "peak_burst":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.PeakBurst = size
+	case "committed_burst":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.CommittedBurst = size
+	case "limit_rate_after":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.LimitRateAfter = size
+	case "count_rate_after":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.CountRateAfter = true
+	case "transfer_resume_ttl":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("无效的续传保留时间 '%s': %v", d.Val(), err)
+		}
+		rl.TransferResumeTTL = caddy.Duration(dur)
+	case "stall_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("无效的停滞超时 '%s': %v", d.Val(), err)
+		}
+		rl.StallTimeout = caddy.Duration(dur)
+	case "min_client_rate":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.MinClientRate = size
+	case "pacing_interval":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("无效的写入间隔 '%s': %v", d.Val(), err)
+		}
+		rl.PacingInterval = caddy.Duration(dur)
+	case "min_chunk_size":
+		size, err := parseByteSize(d)
+		if err != nil {
+			return err
+		}
+		rl.MinChunkSize = int(size)
+	case "disable_write_coalescing":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.DisableWriteCoalescing = true
+	case "dialects":
+		dialects := d.RemainingArgs()
+		if len(dialects) == 0 {
+			return d.ArgErr()
+		}
+		for _, dialect := range dialects {
+			rl.Dialects = append(rl.Dialects, strings.ToLower(dialect))
+		}
+	case "sendfile_root":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		rl.SendfileRoots = append(rl.SendfileRoots, SendfileRoot{Root: args[0], Prefix: args[1]})
+	case "redirect_query":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.RedirectQuery = d.Val()
+	case "allowed_prefixes":
+		prefixes := d.RemainingArgs()
+		if len(prefixes) == 0 {
+			return d.ArgErr()
+		}
+		rl.AllowedPrefixes = append(rl.AllowedPrefixes, prefixes...)
+	case "named_location":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		if rl.NamedLocations == nil {
+			rl.NamedLocations = make(map[string]string)
+		}
+		rl.NamedLocations[strings.TrimPrefix(args[0], "@")] = args[1]
+	case "carry_headers":
+		names := d.RemainingArgs()
+		if len(names) == 0 {
+			return d.ArgErr()
+		}
+		rl.CarryHeaders = append(rl.CarryHeaders, names...)
+	case "reject_control_headers":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.RejectControlHeaders = true
+	case "wait_scheduler":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.WaitScheduler = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "carry_headers_mode":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.CarryHeadersMode = d.Val()
+	case "rate_profile":
+		profile, err := parseRateProfile(d)
+		if err != nil {
+			return err
+		}
+		rl.Profile = profile
+	case "burst_multiplier":
+		multiplier, err := parseBurstMultiplier(d)
+		if err != nil {
+			return err
+		}
+		rl.BurstMultiplier = multiplier
+	case "transfer_burst_multiplier":
+		multiplier, err := parseBurstMultiplier(d)
+		if err != nil {
+			return err
+		}
+		rl.TransferBurstMultiplier = multiplier
+	case "group_burst_multiplier":
+		multiplier, err := parseBurstMultiplier(d)
+		if err != nil {
+			return err
+		}
+		rl.GroupBurstMultiplier = multiplier
+	case "global_burst_multiplier":
+		multiplier, err := parseBurstMultiplier(d)
+		if err != nil {
+			return err
+		}
+		rl.GlobalBurstMultiplier = multiplier
+	case "redis":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rl.Redis = d.Val()
+	default:
+		return d.Errf("未知的子指令 '%s'", d.Val())
+	}
+	return nil
+}
+
+// parseRateProfile 解析rate_profile块
+//
+//	rate_profile {
+//	    ramp_up linear|exponential <duration>
+//	    ramp_down_after_bytes <bytes>
+//	    ramp_down_after <duration>
+//	    ramp_down_rate <bytes_per_sec>
+//	}
+func parseRateProfile(d *caddyfile.Dispenser) (*RateProfile, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	profile := new(RateProfile)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ramp_up":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[1])
+			if err != nil {
+				return nil, d.Errf("无效的爬升时间 '%s': %v", args[1], err)
+			}
+			profile.RampUp = args[0]
+			profile.RampUpDuration = caddy.Duration(dur)
+		case "ramp_down_after_bytes":
+			size, err := parseByteSize(d)
+			if err != nil {
+				return nil, err
+			}
+			profile.RampDownAfterBytes = size
+		case "ramp_down_after":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("无效的降速时间 '%s': %v", d.Val(), err)
+			}
+			profile.RampDownAfter = caddy.Duration(dur)
+		case "ramp_down_rate":
+			size, err := parseByteSize(d)
+			if err != nil {
+				return nil, err
+			}
+			profile.RampDownRate = size
+		default:
+			return nil, d.Errf("未知的rate_profile子指令 '%s'", d.Val())
+		}
+	}
+
+	if err := profile.Validate(); err != nil {
+		return nil, d.Errf("无效的rate_profile: %v", err)
+	}
+	return profile, nil
+}
+
+// parseBurstMultiplier 解析突发倍数参数
+func parseBurstMultiplier(d *caddyfile.Dispenser) (float64, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	multiplier, err := strconv.ParseFloat(d.Val(), 64)
+	if err != nil {
+		return 0, fmt.Errorf("无效的突发倍数: %v", err)
+	}
+	if multiplier <= 0 {
+		return 0, fmt.Errorf("突发倍数必须大于0")
+	}
+	return multiplier, nil
+}
+
+// parseByteSize 解析非负的字节数或速率参数
+func parseByteSize(d *caddyfile.Dispenser) (int64, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	size, err := strconv.ParseInt(d.Val(), 10, 64)
+	if err != nil {
+		return 0, d.Errf("无效的数值 '%s': %v", d.Val(), err)
+	}
+	if size < 0 {
+		return 0, d.Errf("数值不能为负数: %d", size)
+	}
+	return size, nil
+}
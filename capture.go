@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// captureResponseWriter 是一个响应写入器包装器，用于捕获后端的响应头和状态码。
+//
+// 响应头和状态码会被缓冲，直到第一次写入body、Flush或响应结束时才根据响应头
+// 决定如何处理：普通响应的状态码、响应头和body原样转发给客户端；
+// X-Accel响应不写出任何内容并丢弃body，随后由调用者执行内部重定向，
+// 发给客户端的状态码、响应头和body完全由重定向的目标决定。
+type captureResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	statusCode  int
+	header      http.Header
+	wroteHeader bool
+	decided     bool // 是否已经决定如何处理响应
+	accel       bool // 是否为X-Accel响应
+	isAccel     func(http.Header) bool
+
+	// 原样转发普通响应之前按后端响应头包装底层ResponseWriter，为nil时不包装
+	forward func(http.ResponseWriter, http.Header) http.ResponseWriter
+}
+
+// newCaptureResponseWriter 创建新的响应捕获器
+func newCaptureResponseWriter(w http.ResponseWriter, isAccel func(http.Header) bool) *captureResponseWriter {
+	return &captureResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		statusCode:            http.StatusOK,
+		header:                make(http.Header),
+		isAccel:               isAccel,
+	}
+}
+
+// WriteHeader 实现http.ResponseWriter接口
+func (crw *captureResponseWriter) WriteHeader(statusCode int) {
+	if crw.wroteHeader || crw.decided {
+		return
+	}
+
+	// 1xx信息响应（如103 Early Hints）直接转发，不影响最终响应
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		crw.copyHeader()
+		crw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	crw.statusCode = statusCode
+	crw.wroteHeader = true
+
+	// 协议升级（如WebSocket）之后连接会被接管，必须立即转发
+	if statusCode == http.StatusSwitchingProtocols {
+		crw.decide()
+	}
+}
+
+// Header 实现http.ResponseWriter接口。决定转发响应之后返回底层的响应头，
+// 使后端在写入body之后设置的响应头（如reverse_proxy复制的gRPC trailer）也能到达客户端
+func (crw *captureResponseWriter) Header() http.Header {
+	if crw.decided && !crw.accel {
+		return crw.ResponseWriter.Header()
+	}
+	return crw.header
+}
+
+// Write 实现http.ResponseWriter接口
+func (crw *captureResponseWriter) Write(b []byte) (int, error) {
+	crw.decide()
+	if crw.accel {
+		return len(b), nil
+	}
+	return crw.ResponseWriter.Write(b)
+}
+
+// ReadFrom 实现io.ReaderFrom接口，普通响应仍可使用底层的零拷贝路径
+func (crw *captureResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	crw.decide()
+	if crw.accel {
+		return io.Copy(io.Discard, r)
+	}
+	return crw.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Flush 实现http.Flusher接口，X-Accel响应的Flush会被忽略
+func (crw *captureResponseWriter) Flush() {
+	crw.decide()
+	if crw.accel {
+		return
+	}
+	_ = http.NewResponseController(crw.ResponseWriter).Flush()
+}
+
+// Hijack 实现http.Hijacker接口。连接被接管后不能再写出缓冲的响应头
+func (crw *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(crw.ResponseWriter).Hijack()
+	if err == nil {
+		crw.decided = true
+	}
+	return conn, brw, err
+}
+
+// Push 实现http.Pusher接口
+func (crw *captureResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return pushThrough(crw.ResponseWriter, target, opts)
+}
+
+// Unwrap 返回底层ResponseWriter，使http.ResponseController可以穿过捕获器
+func (crw *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return crw.ResponseWriter
+}
+
+// decide 根据缓冲的响应头决定如何处理响应，只执行一次。
+// 普通响应会在这里写出状态码和响应头
+func (crw *captureResponseWriter) decide() {
+	if crw.decided {
+		return
+	}
+	crw.decided = true
+	crw.accel = crw.isAccel(crw.header)
+
+	if crw.accel {
+		return
+	}
+	// 协议升级之后连接会被接管，不能再包装
+	if crw.forward != nil && crw.statusCode != http.StatusSwitchingProtocols {
+		crw.ResponseWriter = crw.forward(crw.ResponseWriter, crw.header)
+	}
+	crw.copyHeader()
+	crw.ResponseWriter.WriteHeader(crw.statusCode)
+}
+
+// copyHeader 将缓冲的响应头复制到底层ResponseWriter
+func (crw *captureResponseWriter) copyHeader() {
+	dst := crw.ResponseWriter.Header()
+	for name, values := range crw.header {
+		dst[name] = values
+	}
+}
+
+// finish 在后端处理完成后调用，确保没有body的响应也会被转发，
+// 并关闭转发时包装的ResponseWriter（如发送限速写入器中合并的数据）
+func (crw *captureResponseWriter) finish() error {
+	crw.decide()
+	if closer, ok := crw.ResponseWriter.(io.Closer); ok && !crw.accel {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*captureResponseWriter)(nil)
+	_ http.Flusher        = (*captureResponseWriter)(nil)
+	_ http.Pusher         = (*captureResponseWriter)(nil)
+	_ http.Hijacker       = (*captureResponseWriter)(nil)
+	_ io.ReaderFrom       = (*captureResponseWriter)(nil)
+)
@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// 携带后端响应头的模式
+const (
+	CarryBackend = "backend" // 后端的值优先
+	CarryTarget  = "target"  // 内部重定向目标（如file_server）的值优先
+	CarryOff     = "off"     // 不携带
+)
+
+// defaultCarryHeaders 是与nginx X-Accel-Redirect行为一致的默认携带响应头
+var defaultCarryHeaders = []string{
+	"Content-Type",
+	"Content-Disposition",
+	"Accept-Ranges",
+	"Set-Cookie",
+	"Cache-Control",
+	"Expires",
+}
+
+// headerMergeWriter 在内部重定向的响应头写出前合并后端响应中携带的响应头，
+// 并应用X-Accel-Expires、X-Accel-Charset等nginx响应头的效果
+type headerMergeWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	carried       http.Header
+	preferBackend bool
+	overrides     http.Header // 总是覆盖最终响应的响应头
+	charset       string      // 追加到Content-Type的字符集
+	merged        bool
+}
+
+// merge 合并携带的响应头，只执行一次。Set-Cookie总是追加，
+// 其他响应头按模式决定是否覆盖目标已设置的值
+func (hw *headerMergeWriter) merge() {
+	if hw.merged {
+		return
+	}
+	hw.merged = true
+
+	dst := hw.ResponseWriter.Header()
+	for name, values := range hw.carried {
+		switch {
+		case name == "Set-Cookie":
+			dst[name] = append(dst[name], values...)
+		case hw.preferBackend || len(dst[name]) == 0:
+			dst[name] = values
+		}
+	}
+	for name, values := range hw.overrides {
+		dst[name] = values
+	}
+	if hw.charset != "" {
+		if contentType := withCharset(dst.Get("Content-Type"), hw.charset); contentType != "" {
+			dst.Set("Content-Type", contentType)
+		}
+	}
+}
+
+// WriteHeader 实现http.ResponseWriter接口
+func (hw *headerMergeWriter) WriteHeader(statusCode int) {
+	hw.merge()
+	hw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write 实现http.ResponseWriter接口
+func (hw *headerMergeWriter) Write(b []byte) (int, error) {
+	hw.merge()
+	return hw.ResponseWriter.Write(b)
+}
+
+// ReadFrom 实现io.ReaderFrom接口
+func (hw *headerMergeWriter) ReadFrom(r io.Reader) (int64, error) {
+	hw.merge()
+	return hw.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Flush 实现http.Flusher接口
+func (hw *headerMergeWriter) Flush() {
+	hw.merge()
+	_ = http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+// carryHeaders 根据后端响应头决定最终响应需要合并的响应头，
+// 并在需要时用合并写入器包装内部重定向的ResponseWriter
+func (rl *RateLimit) carryHeaders(w http.ResponseWriter, header http.Header) http.ResponseWriter {
+	hw := &headerMergeWriter{
+		carried:       make(http.Header),
+		preferBackend: rl.CarryHeadersMode != CarryTarget,
+		overrides:     make(http.Header),
+		charset:       header.Get(rl.HeaderCharset),
+	}
+
+	if rl.CarryHeadersMode != CarryOff {
+		for _, name := range rl.CarryHeaders {
+			if values := header.Values(name); len(values) > 0 {
+				hw.carried[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+	if value := header.Get(rl.HeaderExpires); value != "" {
+		if !accelExpires(hw.overrides, value, time.Now()) {
+			rl.logger.Warn("解析缓存时间失败", zap.String("header", rl.HeaderExpires), zap.String("value", value))
+		}
+	}
+	if strings.EqualFold(hw.charset, "off") {
+		hw.charset = ""
+	}
+
+	if len(hw.carried) == 0 && len(hw.overrides) == 0 && hw.charset == "" {
+		return w
+	}
+	hw.ResponseWriterWrapper = &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}
+	return hw
+}
+
+// passThrough 为原样转发的普通响应应用nginx的X-Accel-Limit-Rate、X-Accel-Limit-Rate-After、
+// X-Accel-Buffering和X-Accel-Charset。与nginx相同，这些响应头对没有内部重定向的代理响应同样生效
+func (rl *RateLimit) passThrough(r *http.Request, w http.ResponseWriter, header http.Header) http.ResponseWriter {
+	if charset := header.Get(rl.HeaderCharset); charset != "" && !strings.EqualFold(charset, "off") {
+		w = &headerMergeWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			charset:               charset,
+		}
+	}
+
+	if rate, ok := rl.parseLimitRate(header); ok && rate > 0 {
+		chain := NewBucketChain()
+		chain.Add(ScopeTransfer, NewAtomicTokenBucket(rate, rl.TransferBurstMultiplier))
+		// 速率曲线只作用于内部重定向的传输
+		opts := rl.transferOptions(r, header)
+		opts.Profile = nil
+		return NewRateLimitWriter(w, chain, opts, rl.logger)
+	}
+	if rl.unbuffered(header) {
+		return newFlushWriter(w)
+	}
+	return w
+}
+
+// unbuffered 判断后端是否用X-Accel-Buffering: no关闭了缓冲
+func (rl *RateLimit) unbuffered(header http.Header) bool {
+	return strings.EqualFold(header.Get(rl.HeaderBuffering), "no")
+}
+
+// flushWriter 在每次写入后立即Flush，用于没有经过限速写入器的X-Accel-Buffering: no
+type flushWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+}
+
+// newFlushWriter 创建每次写入后立即Flush的ResponseWriter
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+}
+
+// Write 实现http.ResponseWriter接口
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.ResponseWriter.Write(b)
+	if err == nil {
+		_ = http.NewResponseController(fw.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+// ReadFrom 实现io.ReaderFrom接口
+func (fw *flushWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := fw.ResponseWriterWrapper.ReadFrom(r)
+	if err == nil {
+		_ = http.NewResponseController(fw.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+// accelExpires 按nginx的X-Accel-Expires语义生成Cache-Control和Expires：
+// 秒数表示相对当前时间的缓存时间，@开头表示Unix时间戳，0表示不缓存，off表示不处理。
+// 值无效时返回false
+func accelExpires(dst http.Header, value string, now time.Time) bool {
+	if strings.EqualFold(value, "off") {
+		return true
+	}
+
+	var expires time.Time
+	if ts, ok := strings.CutPrefix(value, "@"); ok {
+		seconds, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || seconds < 0 {
+			return false
+		}
+		expires = time.Unix(seconds, 0)
+	} else {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 0 {
+			return false
+		}
+		expires = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	maxAge := int64(expires.Sub(now) / time.Second)
+	if maxAge <= 0 {
+		dst.Set("Cache-Control", "no-cache")
+		dst.Set("Expires", now.UTC().Format(http.TimeFormat))
+		return true
+	}
+	dst.Set("Cache-Control", "max-age="+strconv.FormatInt(maxAge, 10))
+	dst.Set("Expires", expires.UTC().Format(http.TimeFormat))
+	return true
+}
+
+// withCharset 为没有指定字符集的Content-Type追加字符集，无需修改时返回空字符串
+func withCharset(contentType, charset string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return ""
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*headerMergeWriter)(nil)
+	_ http.Flusher        = (*headerMergeWriter)(nil)
+	_ io.ReaderFrom       = (*headerMergeWriter)(nil)
+	_ http.ResponseWriter = (*flushWriter)(nil)
+	_ io.ReaderFrom       = (*flushWriter)(nil)
+)
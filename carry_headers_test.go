@@ -0,0 +1,202 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// accelBackend 返回一个测试用的next：原始请求按redirect决定是否返回X-Accel响应并设置header，
+// body由write写出；内部请求同样由write写出
+func accelBackend(redirect bool, header http.Header, write func(http.ResponseWriter) error) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if IsInternalRedirect(r) {
+			w.Header().Set("Content-Type", "text/plain")
+			return write(w)
+		}
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		if redirect {
+			w.Header().Set("X-Accel-Redirect", "/files/file.txt")
+			return nil
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		return write(w)
+	})
+}
+
+// forEachMode 对原样转发的普通响应和不限速的内部重定向分别运行测试
+func forEachMode(t *testing.T, test func(t *testing.T, redirect bool)) {
+	for _, mode := range []struct {
+		name     string
+		redirect bool
+	}{{"PassThrough", false}, {"Redirect", true}} {
+		t.Run(mode.name, func(t *testing.T) { test(t, mode.redirect) })
+	}
+}
+
+func TestAccelLimitRate(t *testing.T) {
+	const size = 8 * 1024
+	body := bytes.Repeat([]byte("x"), size)
+	forEachMode(t, func(t *testing.T, redirect bool) {
+		for _, tc := range []struct {
+			name    string
+			header  http.Header
+			minTime time.Duration
+		}{
+			// 16KB/s发送8KB至少需要约0.5秒，去掉首块前的等待误差
+			{"limited", http.Header{"X-Accel-Limit-Rate": {"16384"}}, 400 * time.Millisecond},
+			{"unlimited", http.Header{"X-Accel-Limit-Rate": {"0"}}, 0},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				rl := newTestRateLimit(t, &RateLimit{})
+				next := accelBackend(redirect, tc.header, func(w http.ResponseWriter) error {
+					_, err := w.Write(body)
+					return err
+				})
+				srv := newTestServer(t, &interceptedRateLimit{rl}, next)
+
+				start := time.Now()
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				elapsed := time.Since(start)
+				if err != nil || !bytes.Equal(got, body) {
+					t.Fatalf("body长度 %d, %v; 期望 %d", len(got), err, size)
+				}
+				if elapsed < tc.minTime {
+					t.Errorf("传输耗时 %v，期望至少 %v", elapsed, tc.minTime)
+				}
+				if tc.minTime == 0 && elapsed > 200*time.Millisecond {
+					t.Errorf("不限速的传输耗时 %v", elapsed)
+				}
+				if value := resp.Header.Get("X-Accel-Limit-Rate"); value != "" {
+					t.Errorf("控制头泄露给客户端: %s", value)
+				}
+			})
+		}
+	})
+}
+
+func TestAccelBufferingNo(t *testing.T) {
+	forEachMode(t, func(t *testing.T, redirect bool) {
+		rl := newTestRateLimit(t, &RateLimit{})
+		received := make(chan struct{})
+		next := accelBackend(redirect, http.Header{"X-Accel-Buffering": {"no"}}, func(w http.ResponseWriter) error {
+			// 第一段数据必须在处理器继续之前到达客户端
+			if _, err := io.WriteString(w, "first;"); err != nil {
+				return err
+			}
+			select {
+			case <-received:
+			case <-time.After(2 * time.Second):
+			}
+			_, err := io.WriteString(w, "second")
+			return err
+		})
+		srv := newTestServer(t, rl, next)
+
+		// 没有Flush时响应头也不会发出，因此从发出请求开始计时
+		start := time.Now()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		first := make([]byte, len("first;"))
+		if _, err := io.ReadFull(resp.Body, first); err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited > time.Second {
+			t.Errorf("第一段数据在 %v 之后才到达，没有立即发送", waited)
+		}
+		close(received)
+		rest, _ := io.ReadAll(resp.Body)
+		if string(first)+string(rest) != "first;second" {
+			t.Errorf("body = %q", string(first)+string(rest))
+		}
+	})
+}
+
+func TestAccelCharset(t *testing.T) {
+	forEachMode(t, func(t *testing.T, redirect bool) {
+		rl := newTestRateLimit(t, &RateLimit{})
+		next := accelBackend(redirect, http.Header{"X-Accel-Charset": {"utf-8"}}, func(w http.ResponseWriter) error {
+			_, err := io.WriteString(w, "text")
+			return err
+		})
+		srv := newTestServer(t, rl, next)
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		if value := resp.Header.Get("X-Accel-Charset"); value != "" {
+			t.Errorf("控制头泄露给客户端: %s", value)
+		}
+	})
+}
+
+func TestAccelExpires(t *testing.T) {
+	for _, tc := range []struct {
+		value        string
+		cacheControl string
+	}{
+		{"60", "max-age=60"},
+		{"0", "no-cache"},
+		{"off", ""},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			rl := newTestRateLimit(t, &RateLimit{})
+			next := accelBackend(true, http.Header{"X-Accel-Expires": {tc.value}}, func(w http.ResponseWriter) error {
+				_, err := io.WriteString(w, "file")
+				return err
+			})
+			srv := newTestServer(t, rl, next)
+
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Cache-Control"); got != tc.cacheControl {
+				t.Errorf("Cache-Control = %q, 期望 %q", got, tc.cacheControl)
+			}
+			if expires := resp.Header.Get("Expires"); (tc.cacheControl == "") != (expires == "") {
+				t.Errorf("Expires = %q", expires)
+			}
+			if value := resp.Header.Get("X-Accel-Expires"); value != "" {
+				t.Errorf("控制头泄露给客户端: %s", value)
+			}
+		})
+	}
+}
+
+// interceptedRateLimit 在内部请求前加上RateLimitInterceptor，与x_accel的serve块相同
+type interceptedRateLimit struct {
+	rl *RateLimit
+}
+
+func (h *interceptedRateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	interceptor := &RateLimitInterceptor{logger: h.rl.logger}
+	target := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			return next.ServeHTTP(w, r)
+		}
+		return interceptor.ServeHTTP(w, r, next)
+	})
+	return h.rl.ServeHTTP(w, r, target)
+}
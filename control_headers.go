@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// accelHeaderPrefix 是X-Accel控制头的公共前缀，带有该前缀的头总是被视为控制头，
+// 包括以后新增的X-Accel字段
+const accelHeaderPrefix = "X-Accel-"
+
+// errControlHeaders 表示客户端请求中包含控制头
+var errControlHeaders = errors.New("请求中包含控制头")
+
+// controlHeaderNames 返回配置的所有控制头名称
+func (rl *RateLimit) controlHeaderNames() []string {
+	names := []string{
+		"X-Accel-Redirect",
+		"X-Sendfile",
+		"X-Lighttpd-Send-File",
+		rl.HeaderUserID,
+		rl.HeaderRateLimit,
+		rl.HeaderGroupID,
+		rl.HeaderGroupRateLimit,
+		rl.HeaderRateLimitCeil,
+		rl.HeaderGroupRateLimitCeil,
+		rl.HeaderPeakRateLimit,
+		rl.HeaderPeakBurst,
+		rl.HeaderCommittedBurst,
+		rl.HeaderLimitRateAfter,
+		rl.HeaderTransferRateLimit,
+		rl.HeaderLimitRate,
+		rl.HeaderBuffering,
+		rl.HeaderExpires,
+		rl.HeaderCharset,
+	}
+	for i, name := range names {
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	return names
+}
+
+// scrubHeaders 删除所有控制头，返回是否删除了任何头
+func scrubHeaders(header http.Header, names []string) bool {
+	scrubbed := false
+	for _, name := range names {
+		if _, ok := header[name]; ok {
+			delete(header, name)
+			scrubbed = true
+		}
+	}
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), accelHeaderPrefix) {
+			delete(header, name)
+			scrubbed = true
+		}
+	}
+	return scrubbed
+}
+
+// scrubWriter 在响应头写出前删除其中的控制头，
+// 保证后端的用户ID、限速值和内部路径不会泄露给客户端
+type scrubWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	names       []string
+	wroteHeader bool
+}
+
+// newScrubWriter 创建删除控制头的写入器
+func newScrubWriter(w http.ResponseWriter, names []string) *scrubWriter {
+	return &scrubWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		names:                 names,
+	}
+}
+
+// WriteHeader 实现http.ResponseWriter接口，1xx信息响应同样会被清理
+func (sw *scrubWriter) WriteHeader(statusCode int) {
+	scrubHeaders(sw.ResponseWriter.Header(), sw.names)
+	if statusCode >= http.StatusOK || statusCode == http.StatusSwitchingProtocols {
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write 实现http.ResponseWriter接口
+func (sw *scrubWriter) Write(b []byte) (int, error) {
+	sw.scrub()
+	return sw.ResponseWriter.Write(b)
+}
+
+// ReadFrom 实现io.ReaderFrom接口
+func (sw *scrubWriter) ReadFrom(r io.Reader) (int64, error) {
+	sw.scrub()
+	return sw.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Flush 实现http.Flusher接口
+func (sw *scrubWriter) Flush() {
+	sw.scrub()
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// scrub 在隐式写出响应头之前清理控制头
+func (sw *scrubWriter) scrub() {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		scrubHeaders(sw.ResponseWriter.Header(), sw.names)
+	}
+}
+
+// scrubRequest 处理客户端请求中的控制头。客户端伪造的控制头不能到达后端，
+// 默认直接删除，配置了reject_control_headers时拒绝请求
+func (rl *RateLimit) scrubRequest(r *http.Request) error {
+	if !scrubHeaders(r.Header, rl.controlHeaders) {
+		return nil
+	}
+	if rl.RejectControlHeaders {
+		rl.logger.Warn("拒绝包含控制头的请求", zap.String("remoteAddr", r.RemoteAddr))
+		return caddyhttp.Error(http.StatusBadRequest, errControlHeaders)
+	}
+	rl.logger.Debug("已删除请求中的控制头", zap.String("remoteAddr", r.RemoteAddr))
+	return nil
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*scrubWriter)(nil)
+	_ http.Flusher        = (*scrubWriter)(nil)
+	_ io.ReaderFrom       = (*scrubWriter)(nil)
+)
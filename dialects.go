@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 支持的内部重定向响应头方言
+const (
+	DialectXAccel   = "x-accel"              // nginx的X-Accel-Redirect，值为URI
+	DialectSendfile = "x-sendfile"           // Apache的X-Sendfile，值为文件系统绝对路径
+	DialectLighttpd = "x-lighttpd-send-file" // lighttpd的X-LIGHTTPD-send-file，值为文件系统绝对路径
+)
+
+// dialectHeaders 是各方言使用的响应头，按匹配优先级排列
+var dialectHeaders = []struct {
+	dialect string
+	header  string
+}{
+	{DialectXAccel, "X-Accel-Redirect"},
+	{DialectSendfile, "X-Sendfile"},
+	{DialectLighttpd, "X-Lighttpd-Send-File"},
+}
+
+// SendfileRoot 将文件系统目录映射为内部重定向的URI前缀。
+// X-Sendfile类方言给出的路径必须位于某个已配置的根目录下
+type SendfileRoot struct {
+	// 文件系统中的根目录，必须是绝对路径
+	Root string `json:"root"`
+
+	// 根目录对应的URI前缀，必须以/开头
+	Prefix string `json:"prefix"`
+}
+
+// validateDialects 检查方言和根目录映射配置
+func (rl *RateLimit) validateDialects() error {
+	for _, dialect := range rl.Dialects {
+		if dialectHeader(dialect) == "" {
+			return fmt.Errorf("未知的重定向方言: %s", dialect)
+		}
+	}
+	for _, root := range rl.SendfileRoots {
+		if !filepath.IsAbs(root.Root) {
+			return fmt.Errorf("sendfile_root的根目录必须是绝对路径: %s", root.Root)
+		}
+		if !strings.HasPrefix(root.Prefix, "/") {
+			return fmt.Errorf("sendfile_root的URI前缀必须以/开头: %s", root.Prefix)
+		}
+	}
+	return nil
+}
+
+// dialectHeader 返回方言使用的响应头，未知方言返回空字符串
+func dialectHeader(dialect string) string {
+	for _, dh := range dialectHeaders {
+		if dh.dialect == dialect {
+			return dh.header
+		}
+	}
+	return ""
+}
+
+// redirectHeader 返回后端响应中第一个已启用方言的重定向响应头及其方言
+func (rl *RateLimit) redirectHeader(header http.Header) (dialect, value string) {
+	for _, dh := range dialectHeaders {
+		if !rl.dialectEnabled(dh.dialect) {
+			continue
+		}
+		if value := header.Get(dh.header); value != "" {
+			return dh.dialect, value
+		}
+	}
+	return "", ""
+}
+
+// dialectEnabled 判断方言是否已启用
+func (rl *RateLimit) dialectEnabled(dialect string) bool {
+	for _, d := range rl.Dialects {
+		if d == dialect {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectTarget 将后端给出的重定向值解析为内部重定向的URI。
+// X-Accel-Redirect的值本身就是URI；文件路径类方言按根目录映射转换为URI
+func (rl *RateLimit) redirectTarget(dialect, value string) (string, error) {
+	if dialect == DialectXAccel {
+		return value, nil
+	}
+	mapped, err := rl.mapSendfilePath(value)
+	if err != nil {
+		return "", err
+	}
+	// 文件名中的?、%等字符不能被当作URI语法解析
+	return (&url.URL{Path: mapped}).EscapedPath(), nil
+}
+
+// mapSendfilePath 将文件系统绝对路径映射为URI，路径不在任何已配置根目录下时返回错误
+func (rl *RateLimit) mapSendfilePath(name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		return "", fmt.Errorf("文件路径必须是绝对路径: %s", name)
+	}
+	name = filepath.Clean(name)
+
+	for _, root := range rl.SendfileRoots {
+		rel, err := filepath.Rel(filepath.Clean(root.Root), name)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return path.Join(root.Prefix, filepath.ToSlash(rel)), nil
+	}
+	return "", fmt.Errorf("文件路径不在允许的根目录下: %s", name)
+}
@@ -0,0 +1,109 @@
+//go:build unix
+
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMapSendfilePath(t *testing.T) {
+	rl := &RateLimit{SendfileRoots: []SendfileRoot{
+		{Root: "/srv/files", Prefix: "/protected"},
+		{Root: "/var/media/", Prefix: "/media/"},
+	}}
+	tests := []struct {
+		name string
+		want string // 为空表示应当拒绝
+	}{
+		{"/srv/files/a.txt", "/protected/a.txt"},
+		{"/srv/files/dir/b.txt", "/protected/dir/b.txt"},
+		{"/srv/files//dir/./b.txt", "/protected/dir/b.txt"},
+		{"/srv/files", "/protected"},
+		{"/var/media/v.mp4", "/media/v.mp4"},
+		{"/srv/files/..data/a.txt", "/protected/..data/a.txt"},
+		{"/srv/files/dir/../a.txt", "/protected/a.txt"},
+		{"/srv/files/../secret.txt", ""},
+		{"/srv/files/dir/../../secret.txt", ""},
+		{"/srv/files/..", ""},
+		{"/srv/files-private/a.txt", ""},
+		{"/srv/filesX", ""},
+		{"/var/mediaX/v.mp4", ""},
+		{"/etc/passwd", ""},
+		{"srv/files/a.txt", ""},
+		{"./srv/files/a.txt", ""},
+		{"../srv/files/a.txt", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := rl.mapSendfilePath(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("mapSendfilePath(%q) = %q, 期望拒绝", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("mapSendfilePath(%q) = %q, %v, 期望 %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSendfileTargetIsEscaped(t *testing.T) {
+	rl := &RateLimit{SendfileRoots: []SendfileRoot{{Root: "/srv/files", Prefix: "/protected"}}}
+	// 文件名中的?、%和#不能被当作查询参数、转义或片段
+	got, err := rl.redirectTarget(DialectSendfile, "/srv/files/a?b%20#c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/protected/a%3Fb%2520%23c.txt"; got != want {
+		t.Fatalf("redirectTarget = %q, 期望 %q", got, want)
+	}
+}
+
+func TestSendfileOutsideRootReturns502(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{
+		Dialects:      []string{DialectSendfile},
+		SendfileRoots: []SendfileRoot{{Root: "/srv/files", Prefix: "/protected"}},
+	})
+
+	// 原始请求的查询参数file作为后端返回的X-Sendfile，内部请求返回自己看到的路径
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			w.Header().Set("X-Sendfile", r.URL.Query().Get("file"))
+			return nil
+		}
+		_, err := w.Write([]byte(r.URL.Path))
+		return err
+	})
+	srv := newTestServer(t, rl, next)
+
+	tests := []struct {
+		file   string
+		status int
+		path   string
+	}{
+		{"/srv/files/a.txt", http.StatusOK, "/protected/a.txt"},
+		{"/srv/files/../secret.txt", http.StatusBadGateway, ""},
+		{"/srv/files-private/a.txt", http.StatusBadGateway, ""},
+		{"srv/files/a.txt", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/download?file=" + url.QueryEscape(tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status || string(body) != tt.path {
+			t.Errorf("X-Sendfile %q: 状态码 %d, 路径 %q, 期望 %d, %q", tt.file, resp.StatusCode, body, tt.status, tt.path)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// DualRateBucket 实现双速率（trTCM风格）限速：峰值桶限制短时突发速率，
+// 承诺桶限制长期平均速率，只有同时符合两个桶时才允许发送
+type DualRateBucket struct {
+	peak      Limiter // 峰值速率和峰值突发容量
+	committed Limiter // 持续速率和承诺突发容量
+}
+
+// NewDualRateBucket 创建新的双速率限速器
+func NewDualRateBucket(peak, committed Limiter) *DualRateBucket {
+	return &DualRateBucket{
+		peak:      peak,
+		committed: committed,
+	}
+}
+
+// Allow 仅当峰值桶和承诺桶都有足够令牌时才消耗令牌
+func (db *DualRateBucket) Allow(count int64) bool {
+	if !db.peak.Allow(count) {
+		return false
+	}
+	if !db.committed.Allow(count) {
+		db.peak.Consume(-count)
+		return false
+	}
+	return true
+}
+
+// Consume 在两个桶上强制消耗令牌，负数表示归还
+func (db *DualRateBucket) Consume(count int64) {
+	db.peak.Consume(count)
+	db.committed.Consume(count)
+}
+
+// Delay 返回两个桶中较长的等待时间
+func (db *DualRateBucket) Delay(count int64) time.Duration {
+	delay := db.peak.Delay(count)
+	if d := db.committed.Delay(count); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// Rate 返回峰值速率，即短时间内可达到的最高速率
+func (db *DualRateBucket) Rate() int64 {
+	return db.peak.Rate()
+}
+
+// Burst 返回两个桶中较小的突发容量
+func (db *DualRateBucket) Burst() int64 {
+	burst := db.peak.Burst()
+	if b := db.committed.Burst(); b < burst {
+		burst = b
+	}
+	return burst
+}
+
+// Interface guards
+var (
+	_ Limiter = (*DualRateBucket)(nil)
+)
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// HTBClass 实现类似Linux HTB的分层限速类。
+//
+// 每个类拥有保证速率rate和上限速率ceil。类优先使用自己的保证带宽，
+// 保证带宽用完后可以向父类借用父类的空闲带宽，但总速率不超过ceil。
+// 使用保证带宽时也会同时占用父类的带宽，因此当带宽的所有者重新活跃时，
+// 父类的空闲令牌减少，借出的带宽会被自然收回。
+type HTBClass struct {
+	rate   Limiter   // 保证速率
+	ceil   Limiter   // 上限速率，为nil时不能超过保证速率借用
+	parent *HTBClass // 父类，为nil时不能借用
+}
+
+// NewHTBClass 创建新的HTB类
+func NewHTBClass(rate, ceil Limiter, parent *HTBClass) *HTBClass {
+	return &HTBClass{
+		rate:   rate,
+		ceil:   ceil,
+		parent: parent,
+	}
+}
+
+// Allow 检查是否允许发送指定数量的字节，优先使用保证带宽，不足时向父类借用
+func (c *HTBClass) Allow(count int64) bool {
+	if c.ceil != nil && c.ceil.Delay(count) > 0 {
+		return false
+	}
+
+	if c.rate.Allow(count) {
+		// 使用自己的保证带宽时同样占用父类带宽
+		if c.parent != nil {
+			c.parent.Consume(count)
+		}
+	} else if c.ceil == nil || c.parent == nil || !c.parent.Allow(count) {
+		return false
+	}
+
+	if c.ceil != nil {
+		c.ceil.Consume(count)
+	}
+	return true
+}
+
+// Consume 在本类及所有祖先类上强制消耗令牌，负数表示归还
+func (c *HTBClass) Consume(count int64) {
+	c.rate.Consume(count)
+	if c.ceil != nil {
+		c.ceil.Consume(count)
+	}
+	if c.parent != nil {
+		c.parent.Consume(count)
+	}
+}
+
+// Delay 返回发送指定数量字节还需等待的时间，取保证带宽与借用带宽中较短者，
+// 且不短于上限速率要求的等待时间
+func (c *HTBClass) Delay(count int64) time.Duration {
+	delay := c.rate.Delay(count)
+	if c.ceil == nil {
+		return delay
+	}
+
+	if c.parent != nil {
+		if borrow := c.parent.Delay(count); borrow < delay {
+			delay = borrow
+		}
+	}
+	if ceilDelay := c.ceil.Delay(count); ceilDelay > delay {
+		delay = ceilDelay
+	}
+	return delay
+}
+
+// Rate 返回本类可达到的最高速率
+func (c *HTBClass) Rate() int64 {
+	if c.ceil != nil {
+		return c.ceil.Rate()
+	}
+	return c.rate.Rate()
+}
+
+// Burst 返回一次最多可以发送的字节数。借用时块大小同样不能超过保证速率的突发容量，
+// 否则父类被同组的其他类占满时，保证带宽永远攒不够一块，本类会被饿死
+func (c *HTBClass) Burst() int64 {
+	burst := c.rate.Burst()
+	if c.ceil != nil {
+		burst = min(burst, c.ceil.Burst())
+	}
+	return burst
+}
+
+// Interface guards
+var (
+	_ Limiter = (*HTBClass)(nil)
+)
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestBucket 创建不使用存储后端的令牌桶，突发容量为0.1秒的流量
+func newTestBucket(rate int64) *TokenBucket {
+	return NewTokenBucket(rate, nil, "test", zap.NewNop(), 0.1)
+}
+
+// sendFor 模拟限速写入器：块大小与chunkSize()相同，按速率×50ms计算且不超过Burst()，
+// 令牌不足时按Delay等待，返回duration内发送的字节数。chunk大于0时使用固定的块大小
+func sendFor(limiter Limiter, chunk int64, duration time.Duration) int64 {
+	var sent int64
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		size := chunk
+		if size <= 0 {
+			size = int64(float64(limiter.Rate()) * defaultPacingInterval.Seconds())
+		}
+		size = min(size, limiter.Burst())
+		if limiter.Allow(size) {
+			sent += size
+			continue
+		}
+		time.Sleep(max(limiter.Delay(size), time.Millisecond))
+	}
+	return sent
+}
+
+func TestHTBGuaranteeUnderContention(t *testing.T) {
+	const (
+		rate     = 100 * 1024
+		ceil     = 10 << 20
+		group    = 2 * rate
+		duration = 500 * time.Millisecond
+	)
+	parent := NewHTBClass(newTestBucket(group), nil, nil)
+	user := NewHTBClass(newTestBucket(rate), newTestBucket(ceil), parent)
+	sibling := NewHTBClass(newTestBucket(rate), newTestBucket(ceil), parent)
+
+	// 块大小不能超过保证速率的令牌桶容量，否则只能向父类借用
+	if burst, limit := user.Burst(), int64(rate/10); burst > limit {
+		t.Errorf("Burst = %d, 超过保证速率的突发容量 %d", burst, limit)
+	}
+
+	var userSent, siblingSent atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		userSent.Store(sendFor(user, 0, duration))
+	}()
+	go func() {
+		// 同组的另一个用户以小块持续发送，占满父类的空闲带宽
+		defer wg.Done()
+		siblingSent.Store(sendFor(sibling, 1024, duration))
+	}()
+	wg.Wait()
+
+	// 令牌桶初始为空，duration内保证速率最多积累 rate*duration 字节，至少应得到一半
+	if got, want := userSent.Load(), int64(rate*duration.Seconds()/2); got < want {
+		t.Errorf("用户在竞争下发送了 %d 字节，少于保证速率的一半 %d", got, want)
+	}
+	// 两个用户合计不能超过父类速率加上各自的突发容量
+	if total, limit := userSent.Load()+siblingSent.Load(), int64(group*duration.Seconds())+2*rate/10; total > limit {
+		t.Errorf("同组合计发送 %d 字节，超过父类上限 %d", total, limit)
+	}
+}
+
+func TestHTBBorrowsUpToCeil(t *testing.T) {
+	const (
+		rate     = 50 * 1024
+		ceil     = 150 * 1024
+		group    = 1 << 20
+		duration = 500 * time.Millisecond
+	)
+	parent := NewHTBClass(newTestBucket(group), nil, nil)
+	user := NewHTBClass(newTestBucket(rate), newTestBucket(ceil), parent)
+
+	// 父类空闲时借用到ceil为止，但不超过ceil
+	sent := sendFor(user, 0, duration)
+	if min := int64(2 * rate * duration.Seconds()); sent < min {
+		t.Errorf("父类空闲时只发送了 %d 字节，期望至少 %d", sent, min)
+	}
+	if max := int64(ceil*duration.Seconds()) + ceil/10; sent > max {
+		t.Errorf("发送了 %d 字节，超过上限速率 %d", sent, max)
+	}
+}
@@ -46,25 +46,31 @@ func (rli *RateLimitInterceptor) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		zap.String("path", r.URL.Path),
 		zap.String("remoteAddr", r.RemoteAddr))
 
-	// 从请求上下文中获取令牌桶
-	bucket := GetTokenBucketFromContext(r)
-	if bucket == nil {
+	// 从请求上下文中获取令牌桶链
+	chain := GetBucketChainFromContext(r)
+	if chain == nil {
 		// 如果没有令牌桶，直接放行
 		rli.logger.Debug("未找到令牌桶，跳过限速")
 		return next.ServeHTTP(w, r)
 	}
 
 	// 记录令牌桶信息
-	rli.logger.Debug("找到令牌桶，应用限速", 
-		zap.Int64("rate", bucket.Rate()),
-		zap.Float64("tokens", bucket.Tokens()))
+	rli.logger.Debug("找到令牌桶链，应用限速", 
+		zap.Strings("scopes", chain.Scopes()),
+		zap.Int64("rate", chain.Rate()))
 
 	// 创建限速响应写入器
-	rateLimitWriter := NewRateLimitWriter(w, bucket, rli.logger)
+	rateLimitWriter := NewRateLimitWriter(w, chain, GetTransferOptionsFromContext(r), rli.logger)
 	
 	// 使用限速写入器处理响应
 	rli.logger.Debug("应用限速写入器")
-	return next.ServeHTTP(rateLimitWriter, r)
+	err := next.ServeHTTP(rateLimitWriter, r)
+
+	// 响应结束时发送合并缓冲区中剩余的数据
+	if closeErr := rateLimitWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // parseInterceptorCaddyfile 解析 rate_limit_interceptor 指令
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RateLimitInternal{})
+	caddy.RegisterModule(MatchInternal{})
+	httpcaddyfile.RegisterHandlerDirective("rate_limit_internal", parseInternalCaddyfile)
+	// 设置指令顺序，确保在 file_server 之前运行。
+	// 只能相对于标准指令排序，rate_limit_interceptor 已经先插入在 file_server 之前
+	httpcaddyfile.RegisterDirectiveOrder("rate_limit_internal", httpcaddyfile.Before, "file_server")
+}
+
+// internalRedirectKey 是内部重定向标记的上下文键。
+// 键的类型未导出，客户端和其他模块都无法伪造这个标记
+type internalRedirectKey struct{}
+
+// withInternalRedirect 在上下文中标记请求由内部重定向产生
+func withInternalRedirect(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalRedirectKey{}, true)
+}
+
+// IsInternalRedirect 判断请求是否由rate_limit_dynamic的内部重定向产生
+func IsInternalRedirect(r *http.Request) bool {
+	internal, _ := r.Context().Value(internalRedirectKey{}).(bool)
+	return internal
+}
+
+// RateLimitInternal 与nginx的internal指令相同，只允许内部重定向产生的请求通过，
+// 客户端直接访问时返回404，避免绕过后端的鉴权和限速
+type RateLimitInternal struct {
+	logger *zap.Logger
+}
+
+// CaddyModule 返回Caddy模块信息
+func (RateLimitInternal) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.rate_limit_internal",
+		New: func() caddy.Module { return new(RateLimitInternal) },
+	}
+}
+
+// Provision 实现caddy.Provisioner接口
+func (rli *RateLimitInternal) Provision(ctx caddy.Context) error {
+	rli.logger = ctx.Logger(rli)
+	return nil
+}
+
+// ServeHTTP 实现caddyhttp.MiddlewareHandler接口
+func (rli *RateLimitInternal) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !IsInternalRedirect(r) {
+		rli.logger.Debug("拒绝直接访问内部路径",
+			zap.String("path", r.URL.Path),
+			zap.String("remoteAddr", r.RemoteAddr))
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// parseInternalCaddyfile 解析 rate_limit_internal 指令
+func parseInternalCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var rli RateLimitInternal
+
+	for h.Next() {
+		// 指令行不应有参数
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+	}
+
+	return &rli, nil
+}
+
+// MatchInternal 匹配由内部重定向产生的请求，可用于命名匹配器：
+//
+//	@internal rate_limit_internal
+type MatchInternal struct{}
+
+// CaddyModule 返回Caddy模块信息
+func (MatchInternal) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.rate_limit_internal",
+		New: func() caddy.Module { return new(MatchInternal) },
+	}
+}
+
+// Match 实现caddyhttp.RequestMatcher接口
+func (MatchInternal) Match(r *http.Request) bool {
+	return IsInternalRedirect(r)
+}
+
+// UnmarshalCaddyfile 实现 caddyfile.Unmarshaler 接口
+func (m *MatchInternal) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RateLimitInternal)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RateLimitInternal)(nil)
+	_ caddyhttp.RequestMatcher    = (*MatchInternal)(nil)
+	_ caddyfile.Unmarshaler       = (*MatchInternal)(nil)
+)
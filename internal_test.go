@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/caddyserver/caddy/v2/modules/standard"
+	"go.uber.org/zap"
+)
+
+// testRoute 是Caddyfile适配结果中的一条路由
+type testRoute struct {
+	Match    []map[string][]string `json:"match"`
+	Handle   []json.RawMessage     `json:"handle"`
+	Terminal bool                  `json:"terminal"`
+}
+
+// adaptRoutes 用Caddyfile适配器转换配置，返回第一个服务器的路由
+func adaptRoutes(t *testing.T, input string) []testRoute {
+	t.Helper()
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []testRoute `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range config.Apps.HTTP.Servers {
+		return srv.Routes
+	}
+	t.Fatal("适配结果中没有服务器")
+	return nil
+}
+
+// compileRoutes 按Caddy的路由语义把适配出的路由编译成处理链：匹配失败时交给下一条路由，
+// 子路由的最后交给外层的next，terminal路由之后不再执行后续路由。
+// 测试环境无法通过caddy加载模块，处理器按名称从handlers中取得
+func compileRoutes(t *testing.T, routes []testRoute, handlers map[string]caddyhttp.MiddlewareHandler, next caddyhttp.Handler) caddyhttp.Handler {
+	t.Helper()
+	stack := next
+	for i := len(routes) - 1; i >= 0; i-- {
+		route := routes[i]
+		routeNext := stack
+		if route.Terminal {
+			routeNext = caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+		}
+
+		chain := routeNext
+		for j := len(route.Handle) - 1; j >= 0; j-- {
+			var h struct {
+				Handler string      `json:"handler"`
+				Routes  []testRoute `json:"routes"`
+			}
+			if err := json.Unmarshal(route.Handle[j], &h); err != nil {
+				t.Fatal(err)
+			}
+			inner := chain
+			if h.Handler == "subroute" {
+				chain = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					return compileRoutes(t, h.Routes, handlers, inner).ServeHTTP(w, r)
+				})
+				continue
+			}
+			handler, ok := handlers[h.Handler]
+			if !ok {
+				t.Fatalf("测试不支持处理器 %s", h.Handler)
+			}
+			chain = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				return handler.ServeHTTP(w, r, inner)
+			})
+		}
+
+		matched, skip := chain, stack
+		stack = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if matchTestRoute(route.Match, r) {
+				return matched.ServeHTTP(w, r)
+			}
+			return skip.ServeHTTP(w, r)
+		})
+	}
+	return stack
+}
+
+// matchTestRoute 实现测试用到的path和host匹配器，任意一个匹配器集合满足即匹配
+func matchTestRoute(sets []map[string][]string, r *http.Request) bool {
+	if len(sets) == 0 {
+		return true
+	}
+	for _, set := range sets {
+		ok := true
+		for name, patterns := range set {
+			matched := false
+			for _, pattern := range patterns {
+				switch name {
+				case "path":
+					matched, _ = path.Match(pattern, r.URL.Path)
+				case "host":
+					matched = pattern == r.Host
+				}
+				if matched {
+					break
+				}
+			}
+			ok = ok && matched
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareFunc 将函数转换为caddyhttp.MiddlewareHandler
+type middlewareFunc func(http.ResponseWriter, *http.Request, caddyhttp.Handler) error
+
+func (f middlewareFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return f(w, r, next)
+}
+
+func TestInternalReadmeExample(t *testing.T) {
+	// 与README“内部路径保护”一节的示例相同
+	routes := adaptRoutes(t, `example.com {
+	route {
+		rate_limit_dynamic
+		reverse_proxy /api/* backend:8080
+
+		handle /protected/* {
+			rate_limit_internal
+			rate_limit_interceptor
+			file_server
+		}
+	}
+}`)
+
+	rl := newTestRateLimit(t, &RateLimit{})
+	handlers := map[string]caddyhttp.MiddlewareHandler{
+		"rate_limit_dynamic":     rl,
+		"rate_limit_internal":    &RateLimitInternal{logger: zap.NewNop()},
+		"rate_limit_interceptor": &RateLimitInterceptor{logger: zap.NewNop()},
+		// 后端鉴权通过后把下载重定向到受保护的路径
+		"reverse_proxy": middlewareFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+			w.Header().Set("X-Accel-Redirect", "/protected/file.bin")
+			w.Header().Set("X-Accel-User-ID", "1")
+			w.Header().Set("X-Accel-RateLimit", "1048576")
+			return nil
+		}),
+		"file_server": middlewareFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+			_, err := fmt.Fprintf(w, "file:%s", r.URL.Path)
+			return err
+		}),
+	}
+	notFound := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	})
+	handler := compileRoutes(t, routes, handlers, notFound)
+	srv := newTestServer(t, middlewareFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+		r.Host = "example.com"
+		return handler.ServeHTTP(w, r)
+	}), nil)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api/download", http.StatusOK, "file:/protected/file.bin"},
+		{"/protected/file.bin", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || string(body) != tc.body {
+			t.Errorf("%s: 状态码 %d, body %q; 期望 %d %q", tc.path, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+}
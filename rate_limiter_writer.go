@@ -2,29 +2,161 @@ package ratelimit
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math/bits"
 	"net"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// TransferOptions 定义单次传输的限速选项
+type TransferOptions struct {
+	// 传输开头以全速发送的字节数，与nginx的limit_rate_after语义相同
+	RateAfter int64
+
+	// 全速发送的字节是否仍计入令牌桶
+	CountRateAfter bool
+
+	// 单次传输的速率曲线，作用于链中的传输级令牌桶
+	Profile *RateProfile
+
+	// 每次写入前将连接的写超时推迟到当前时间之后的StallTimeout，
+	// 避免因限速而变慢的长传输被服务器的write_timeout中断。0表示不调整
+	StallTimeout time.Duration
+
+	// 客户端的最低接收速率（字节/秒），持续低于该速率超过StallTimeout时终止传输
+	MinClientRate int64
+
+	// 两次写入之间的目标间隔，块大小按速率×间隔计算。0表示使用默认值
+	PacingInterval time.Duration
+
+	// 最小块大小（字节），避免低速时块过小导致系统调用过多。0表示使用默认值
+	MinChunkSize int
+
+	// 将小于一块的写入合并到缓冲区，凑满一块、Flush或响应结束时再按速率发送
+	CoalesceWrites bool
+
+	// 每次写入后立即Flush，对应nginx的X-Accel-Buffering: no
+	FlushWrites bool
+
+	// 由共享时间轮唤醒等待令牌的写入器，否则每次等待使用time.Sleep
+	SharedWheel bool
+
+	// 写出响应头前需要删除的控制头，带有X-Accel-前缀的头总是会被删除
+	ControlHeaders []string
+
+	// 跨Range续传共享的传输状态，为nil时速率曲线只按本次响应计算
+	transfer *transferState
+}
+
+// 分块写入的默认参数
+const (
+	defaultPacingInterval = 50 * time.Millisecond
+	defaultMinChunkSize   = 1024
+	maxChunkSize          = 512 * 1024
+)
+
+// net/http在写入连接前的缓冲区大小：连接上的bufio.Writer为4KB，
+// 分块编码前还有2KB的缓冲。小于该大小的块不Flush时会在缓冲区中积攒，
+// 低速下客户端每隔几百毫秒才收到一批数据，而不是每个间隔收到一块
+const serverBufferSize = 4 * 1024
+
+// 合并缓冲区的容量从1KB到maxChunkSize按2的幂分级，每级一个池，
+// 低速传输只占用与块大小相当的缓冲区
+const (
+	minBufferShift = 10
+	maxBufferShift = 19
+)
+
+// chunkBufferPools 按容量等级复用合并小块写入的缓冲区
+var chunkBufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass 返回能容纳size字节的最小容量等级
+func bufferClass(size int) int {
+	if size <= 1<<minBufferShift {
+		return 0
+	}
+	return min(bits.Len(uint(size-1)), maxBufferShift) - minBufferShift
+}
+
+// getChunkBuffer 从对应等级的池中取出容量不小于size的空缓冲区
+func getChunkBuffer(size int) *[]byte {
+	class := bufferClass(size)
+	if buf, ok := chunkBufferPools[class].Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, 0, 1<<(class+minBufferShift))
+	return &buf
+}
+
+// putChunkBuffer 清空缓冲区并放回其容量所在等级的池
+func putChunkBuffer(buf *[]byte) {
+	*buf = (*buf)[:0]
+	chunkBufferPools[bufferClass(cap(*buf))].Put(buf)
+}
+
+// ErrClientStalled 表示客户端停止读取或接收过慢，传输被终止
+var ErrClientStalled = errors.New("客户端停滞")
+
 // RateLimitWriter 实现一个限速的http.ResponseWriter
 type RateLimitWriter struct {
 	w           http.ResponseWriter
-	bucket      *TokenBucket
+	bucket      *BucketChain
+	opts        TransferOptions
 	logger      *zap.Logger
 	wroteHeader bool
+	sent        int64          // 本次响应已发送的字节数
+	transfer    *transferState // 启用速率曲线时的传输状态
+	noDeadline  bool      // 底层连接不支持设置写超时
+	slowSince   time.Time // 客户端开始低于最低接收速率的时间
+	pending     *[]byte   // 等待发送的合并缓冲区
+	err         error     // 发送合并缓冲区时发生的错误
 }
 
 // NewRateLimitWriter 创建一个新的限速响应写入器
-func NewRateLimitWriter(w http.ResponseWriter, bucket *TokenBucket, logger *zap.Logger) *RateLimitWriter {
-	return &RateLimitWriter{
+func NewRateLimitWriter(w http.ResponseWriter, bucket *BucketChain, opts TransferOptions, logger *zap.Logger) *RateLimitWriter {
+	rlw := &RateLimitWriter{
 		w:      w,
 		bucket: bucket,
+		opts:   opts,
 		logger: logger,
 	}
+	if opts.Profile != nil {
+		rlw.transfer = opts.transfer
+		if rlw.transfer == nil {
+			// 没有共享的传输状态时以链中的传输级令牌桶开始一次新的传输
+			if bucket, ok := bucket.Limiter(ScopeTransfer).(*AtomicTokenBucket); ok {
+				rlw.transfer = newTransferState(bucket)
+			}
+		}
+	}
+	return rlw
+}
+
+// applyProfile 根据传输进度调整传输级令牌桶的速率
+func (rlw *RateLimitWriter) applyProfile() {
+	if rlw.transfer != nil {
+		rlw.transfer.applyProfile(rlw.opts.Profile)
+	}
+}
+
+// extendDeadline 将连接的写超时推迟到StallTimeout之后。
+// 在等待令牌之后调用，因此限速造成的等待不会计入超时，只有客户端本身过慢才会超时
+func (rlw *RateLimitWriter) extendDeadline() {
+	if rlw.opts.StallTimeout <= 0 || rlw.noDeadline {
+		return
+	}
+	err := http.NewResponseController(rlw.w).SetWriteDeadline(time.Now().Add(rlw.opts.StallTimeout))
+	if err != nil {
+		rlw.noDeadline = true
+		rlw.logger.Debug("无法设置写超时", zap.Error(err))
+	}
 }
 
 // Header 实现http.ResponseWriter接口
@@ -36,6 +168,7 @@ func (rlw *RateLimitWriter) Header() http.Header {
 func (rlw *RateLimitWriter) WriteHeader(statusCode int) {
 	if !rlw.wroteHeader {
 		rlw.wroteHeader = true
+		scrubHeaders(rlw.w.Header(), rlw.opts.ControlHeaders)
 		rlw.w.WriteHeader(statusCode)
 	}
 }
@@ -50,20 +183,78 @@ func (rlw *RateLimitWriter) Write(b []byte) (int, error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
+	if rlw.err != nil {
+		return 0, rlw.err
+	}
+
+	if rlw.opts.CoalesceWrites {
+		// 小块写入先合并到缓冲区，凑满一块后再按速率发送，
+		// 避免每次几百字节的写入都要竞争令牌桶锁和等待
+		if chunkSize := rlw.chunkSize(); len(b) < chunkSize {
+			if rlw.pending != nil && len(*rlw.pending)+len(b) > chunkSize {
+				if err := rlw.drain(); err != nil {
+					return 0, err
+				}
+			}
+			switch {
+			case rlw.pending == nil:
+				rlw.pending = getChunkBuffer(chunkSize)
+			case cap(*rlw.pending) < chunkSize:
+				// 速率提高后块变大，换用更高等级的缓冲区
+				buf := getChunkBuffer(chunkSize)
+				*buf = append(*buf, *rlw.pending...)
+				putChunkBuffer(rlw.pending)
+				rlw.pending = buf
+			}
+			*rlw.pending = append(*rlw.pending, b...)
+			if len(*rlw.pending) >= chunkSize {
+				if err := rlw.drain(); err != nil {
+					return 0, err
+				}
+			}
+			return len(b), nil
+		}
+		if err := rlw.drain(); err != nil {
+			return 0, err
+		}
+	}
+
+	return rlw.writeDirect(b)
+}
+
+// writeDirect 不经过合并缓冲区，直接按限速规则写入
+func (rlw *RateLimitWriter) writeDirect(b []byte) (int, error) {
+	// 传输开头的RateAfter字节以全速发送
+	var bypassed int
+	if rlw.sent < rlw.opts.RateAfter {
+		var err error
+		bypassed, err = rlw.writeUnthrottled(b)
+		if err != nil || bypassed == len(b) {
+			return bypassed, err
+		}
+	}
+
+	n, err := rlw.writeThrottled(b[bypassed:])
+	return bypassed + n, err
+}
+
+// writeUnthrottled 不经过令牌桶直接写入，最多写到第RateAfter字节为止
+func (rlw *RateLimitWriter) writeUnthrottled(b []byte) (int, error) {
+	if remaining := rlw.opts.RateAfter - rlw.sent; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
 
-	// 根据速率动态调整块大小，提高高速率下的性能
-	var chunkSize int
+	n, err := rlw.writeChunk(b)
+	if rlw.opts.CountRateAfter {
+		rlw.bucket.Consume(int64(n))
+	}
+	return n, err
+}
+
+// writeThrottled 按令牌桶链的速率分块写入
+func (rlw *RateLimitWriter) writeThrottled(b []byte) (int, error) {
+	chunkSize := rlw.chunkSize()
 	rate := rlw.bucket.Rate()
-	
-	// 对于高速率（10-100MB/s），使用更大的块大小
-	if rate >= 10*1024*1024 && rate < 50*1024*1024 { // 10-50MB/s
-		chunkSize = 256 * 1024 // 256KB
-	} else if rate >= 50*1024*1024 { // 50MB/s以上
-		chunkSize = 512 * 1024 // 512KB
-	} else {
-		chunkSize = 64 * 1024 // 默认64KB
-	}
-	
 	var written int
 
 	// 记录开始写入的日志
@@ -74,64 +265,24 @@ func (rlw *RateLimitWriter) Write(b []byte) (int, error) {
 
 	for written < len(b) {
 		// 计算当前块大小
-		remainingBytes := len(b) - written
-		currentChunkSize := chunkSize
-		if remainingBytes < chunkSize {
-			currentChunkSize = remainingBytes
-		}
+		currentChunkSize := min(rlw.chunkSize(), len(b)-written)
 
 		// 等待获取足够的令牌
-		startWait := time.Now()
-		waitCount := 0
-		for !rlw.bucket.Allow(int64(currentChunkSize)) {
-			waitCount++
-			// 如果没有足够的令牌，计算精确的等待时间
-			currentRate := rlw.bucket.Rate()
-			if currentRate <= 0 {
-				currentRate = 1024 // 默认1KB/s
-			}
-			
-			// 计算需要等待的时间：(需要的令牌数 - 当前令牌数) / 速率 = 需要的秒数
-			waitTokens := float64(currentChunkSize) - rlw.bucket.Tokens()
-			waitTime := time.Duration(waitTokens / float64(currentRate) * float64(time.Second))
-			
-			// 确保等待时间至少为1毫秒，避免CPU空转
-			if waitTime < time.Millisecond {
-				waitTime = time.Millisecond
-			}
-			
-			// 对于高速率，减少日志频率
-			if waitCount == 1 || waitCount%10 == 0 || waitTime > 100*time.Millisecond {
-				rlw.logger.Debug("限速等待", 
-					zap.Duration("waitTime", waitTime), 
-					zap.Int("chunkSize", currentChunkSize), 
-					zap.Int64("rate", currentRate),
-					zap.Float64("currentTokens", rlw.bucket.Tokens()),
-					zap.Float64("waitTokens", waitTokens),
-					zap.Int("waitCount", waitCount))
-			}
-			
-			time.Sleep(waitTime)
-		}
-
-		// 如果等待时间超过阈值，记录日志
-		waitDuration := time.Since(startWait)
-		if waitDuration > 100*time.Millisecond {
-			rlw.logger.Debug("限速等待完成", 
-				zap.Duration("totalWaitTime", waitDuration), 
-				zap.Int("waitCount", waitCount))
-		}
+		rlw.waitForTokens(currentChunkSize)
 
 		// 写入当前块
-		n, err := rlw.w.Write(b[written:written+currentChunkSize])
+		n, err := rlw.writeChunk(b[written:written+currentChunkSize])
 		written += n
 		
-		// 如果写入出错，记录日志并返回
+		// 如果写入出错，归还未发送部分的令牌，记录日志并返回
 		if err != nil {
+			rlw.bucket.Consume(int64(n - currentChunkSize))
 			rlw.logger.Error("写入错误", zap.Error(err), zap.Int("writtenBytes", written))
 			return written, err
 		}
 		
+		rlw.flushPaced(currentChunkSize)
+
 		// 对于高速率，只在特定情况下记录进度
 		if rate < 10*1024*1024 || written == len(b) || written%(1024*1024) == 0 {
 			rlw.logger.Debug("写入进度", 
@@ -146,25 +297,298 @@ func (rlw *RateLimitWriter) Write(b []byte) (int, error) {
 	return written, nil
 }
 
-// Hijack 实现http.Hijacker接口（如果底层ResponseWriter支持）
+// ReadFrom 实现io.ReaderFrom接口。数据按块限速，每块仍交给底层写入器的ReadFrom，
+// 使file_server在限速时也能使用sendfile/splice，避免在用户态逐块复制
+func (rlw *RateLimitWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rlw.wroteHeader {
+		rlw.WriteHeader(http.StatusOK)
+	}
+
+	if err := rlw.drain(); err != nil {
+		return 0, err
+	}
+
+	rf, ok := rlw.w.(io.ReaderFrom)
+	if !ok {
+		// 底层不支持时退回到经过Write的普通复制
+		return io.Copy(writerOnly{rlw}, r)
+	}
+
+	// http.ServeContent通过io.CopyN调用ReadFrom，r已经是包装*os.File的*io.LimitedReader。
+	// net包只解开一层LimitedReader，再包一层会退回用户态复制，
+	// 因此直接限制内层的读取器，并自行扣减外层的剩余字节数
+	src := r
+	lr, limited := r.(*io.LimitedReader)
+	if limited {
+		src = lr.R
+	}
+
+	var total int64
+	for {
+		if limited && lr.N <= 0 {
+			return total, nil
+		}
+
+		// 传输开头的RateAfter字节以全速发送，其余按块等待令牌
+		throttled := rlw.sent >= rlw.opts.RateAfter
+		size := rlw.opts.RateAfter - rlw.sent
+		if throttled {
+			size = int64(rlw.chunkSize())
+		}
+		if limited {
+			size = min(size, lr.N)
+		}
+		if throttled {
+			rlw.waitForTokens(int(size))
+		}
+
+		n, err := rlw.track(func() (int64, error) {
+			return rf.ReadFrom(io.LimitReader(src, size))
+		})
+		total += n
+		if limited {
+			lr.N -= n
+		}
+
+		if throttled && n < size {
+			// 归还读到文件末尾或出错时未使用的令牌
+			rlw.bucket.Consume(n - size)
+		} else if !throttled && rlw.opts.CountRateAfter {
+			rlw.bucket.Consume(n)
+		}
+
+		if err != nil {
+			rlw.logger.Error("写入错误", zap.Error(err), zap.Int64("writtenBytes", total))
+			return total, err
+		}
+		if throttled {
+			rlw.flushPaced(int(n))
+		}
+		if n < size {
+			rlw.logger.Debug("限速写入完成", zap.Int64("totalBytes", total))
+			return total, nil
+		}
+	}
+}
+
+// writeChunk 将一块数据写入底层连接
+func (rlw *RateLimitWriter) writeChunk(b []byte) (int, error) {
+	n, err := rlw.track(func() (int64, error) {
+		n, err := rlw.w.Write(b)
+		return int64(n), err
+	})
+	return int(n), err
+}
+
+// track 执行一次对底层连接的写入，推迟写超时、统计已发送字节并检测客户端是否停滞
+func (rlw *RateLimitWriter) track(write func() (int64, error)) (int64, error) {
+	rlw.extendDeadline()
+	start := time.Now()
+	n, err := write()
+	rlw.sent += n
+	if rlw.transfer != nil {
+		rlw.transfer.sent.Add(n)
+	}
+
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, rlw.stalled("写入超时，客户端停止读取", err)
+		}
+		return n, err
+	}
+	if rlw.opts.FlushWrites {
+		_ = http.NewResponseController(rlw.w).Flush()
+	}
+	return n, rlw.checkClient(n, time.Since(start))
+}
+
+// flushPaced 在发送一个限速块之后，块小于服务器缓冲区时立即Flush，
+// 使客户端按pacing_interval收到数据。FlushWrites时track已经Flush过
+func (rlw *RateLimitWriter) flushPaced(size int) {
+	if size > 0 && size < serverBufferSize && !rlw.opts.FlushWrites {
+		_ = http.NewResponseController(rlw.w).Flush()
+	}
+}
+
+// checkClient 根据本次写入耗时估算客户端的接收速率。限速等待不计入耗时，
+// 因此测得的是客户端本身的速率；持续低于MinClientRate超过StallTimeout时终止传输
+func (rlw *RateLimitWriter) checkClient(n int64, elapsed time.Duration) error {
+	if rlw.opts.MinClientRate <= 0 || rlw.opts.StallTimeout <= 0 {
+		return nil
+	}
+
+	// 写入几乎立即完成说明数据进入了发送缓冲区，客户端不是瓶颈
+	if elapsed < time.Millisecond || float64(n)/elapsed.Seconds() >= float64(rlw.opts.MinClientRate) {
+		rlw.slowSince = time.Time{}
+		return nil
+	}
+
+	now := time.Now()
+	if rlw.slowSince.IsZero() {
+		rlw.slowSince = now.Add(-elapsed)
+	}
+	if now.Sub(rlw.slowSince) < rlw.opts.StallTimeout {
+		return nil
+	}
+	return rlw.stalled("客户端接收速率持续低于min_client_rate", nil)
+}
+
+// stalled 记录停滞原因并使连接上后续的写入立即失败，返回ErrClientStalled
+func (rlw *RateLimitWriter) stalled(reason string, cause error) error {
+	rlw.logger.Warn("客户端停滞，终止传输",
+		zap.String("reason", reason),
+		zap.Int64("sentBytes", rlw.sent),
+		zap.Int64("minClientRate", rlw.opts.MinClientRate),
+		zap.Duration("stallTimeout", rlw.opts.StallTimeout),
+		zap.Error(cause))
+
+	if err := http.NewResponseController(rlw.w).SetWriteDeadline(time.Now()); err != nil {
+		rlw.logger.Debug("无法中断连接", zap.Error(err))
+	}
+	return fmt.Errorf("%w: %s", ErrClientStalled, reason)
+}
+
+// chunkSize 根据速率和目标写入间隔计算块大小，使任意速率下两次写入的间隔
+// 都接近PacingInterval，低速时不会出现长时间停顿后的大块突发
+func (rlw *RateLimitWriter) chunkSize() int {
+	rlw.applyProfile()
+
+	interval := rlw.opts.PacingInterval
+	if interval <= 0 {
+		interval = defaultPacingInterval
+	}
+	minChunkSize := rlw.opts.MinChunkSize
+	if minChunkSize <= 0 {
+		minChunkSize = defaultMinChunkSize
+	}
+
+	rate := rlw.bucket.Rate()
+	chunkSize := int(float64(rate) * interval.Seconds())
+	chunkSize = min(max(chunkSize, minChunkSize), maxChunkSize)
+
+	// 块大小不能超过令牌桶链的突发容量，否则永远无法获得足够令牌
+	if burst := int(rlw.bucket.Burst()); chunkSize > burst {
+		chunkSize = max(burst, 1)
+	}
+	return chunkSize
+}
+
+// waitForTokens 阻塞直到令牌桶链允许发送size字节，并消耗相应的令牌
+func (rlw *RateLimitWriter) waitForTokens(size int) {
+	startWait := time.Now()
+	waitCount := 0
+	for !rlw.bucket.Allow(int64(size)) {
+		waitCount++
+		// 如果没有足够的令牌，按最严格的一级计算精确的等待时间
+		waitTime := rlw.bucket.Delay(int64(size))
+		
+		// 确保等待时间至少为1毫秒，避免CPU空转
+		if waitTime < time.Millisecond {
+			waitTime = time.Millisecond
+		}
+		
+		// 对于高速率，减少日志频率
+		if waitCount == 1 || waitCount%10 == 0 || waitTime > 100*time.Millisecond {
+			rlw.logger.Debug("限速等待", 
+				zap.Duration("waitTime", waitTime), 
+				zap.Int("chunkSize", size), 
+				zap.Int64("rate", rlw.bucket.Rate()),
+				zap.Int("waitCount", waitCount))
+		}
+		
+		if rlw.opts.SharedWheel {
+			sharedWheel.Sleep(waitTime)
+		} else {
+			time.Sleep(waitTime)
+		}
+	}
+
+	// 如果等待时间超过阈值，记录日志
+	waitDuration := time.Since(startWait)
+	if waitDuration > 100*time.Millisecond {
+		rlw.logger.Debug("限速等待完成", 
+			zap.Duration("totalWaitTime", waitDuration), 
+			zap.Int("waitCount", waitCount))
+	}
+}
+
+// Hijack 实现http.Hijacker接口（如果底层ResponseWriter链中有支持的写入器）
 func (rlw *RateLimitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hijacker, ok := rlw.w.(http.Hijacker); ok {
-		return hijacker.Hijack()
+	conn, brw, err := http.NewResponseController(rlw.w).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("底层ResponseWriter不支持http.Hijacker接口: %w", err)
+	}
+	return conn, brw, nil
+}
+
+// drain 按限速规则发送合并缓冲区中的数据，出错时记录错误，后续写入直接失败
+func (rlw *RateLimitWriter) drain() error {
+	if rlw.pending == nil || len(*rlw.pending) == 0 {
+		return rlw.err
+	}
+	_, err := rlw.writeDirect(*rlw.pending)
+	*rlw.pending = (*rlw.pending)[:0]
+	if err != nil {
+		rlw.err = err
 	}
-	return nil, nil, fmt.Errorf("底层ResponseWriter不支持http.Hijacker接口")
+	return err
 }
 
-// Flush 实现http.Flusher接口（如果底层ResponseWriter支持）
+// Close 发送合并缓冲区中剩余的数据并归还缓冲区，应在响应结束时调用
+func (rlw *RateLimitWriter) Close() error {
+	err := rlw.drain()
+	if rlw.pending != nil {
+		putChunkBuffer(rlw.pending)
+		rlw.pending = nil
+	}
+	return err
+}
+
+// Flush 实现http.Flusher接口（如果底层ResponseWriter链中有支持的写入器），
+// 先发送合并缓冲区中的数据
 func (rlw *RateLimitWriter) Flush() {
-	if flusher, ok := rlw.w.(http.Flusher); ok {
-		flusher.Flush()
+	if !rlw.wroteHeader {
+		rlw.WriteHeader(http.StatusOK)
+	}
+	if err := rlw.drain(); err != nil {
+		rlw.logger.Debug("发送缓冲数据失败", zap.Error(err))
+		return
+	}
+	if err := http.NewResponseController(rlw.w).Flush(); err != nil {
+		rlw.logger.Debug("刷新响应失败", zap.Error(err))
 	}
 }
 
 // Push 实现http.Pusher接口（如果底层ResponseWriter支持）
 func (rlw *RateLimitWriter) Push(target string, opts *http.PushOptions) error {
-	if pusher, ok := rlw.w.(http.Pusher); ok {
+	return pushThrough(rlw.w, target, opts)
+}
+
+// pushThrough 把推送交给底层ResponseWriter，底层不支持时与net/http一致返回http.ErrNotSupported
+func pushThrough(w http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if pusher, ok := w.(http.Pusher); ok {
 		return pusher.Push(target, opts)
 	}
-	return fmt.Errorf("底层ResponseWriter不支持http.Pusher接口")
+	return http.ErrNotSupported
+}
+
+// Unwrap 返回底层ResponseWriter，使http.ResponseController可以穿过限速写入器
+// 调用SetWriteDeadline、SetReadDeadline、EnableFullDuplex等方法
+func (rlw *RateLimitWriter) Unwrap() http.ResponseWriter {
+	return rlw.w
+}
+
+// writerOnly 隐藏RateLimitWriter的ReadFrom方法，避免io.Copy递归调用
+type writerOnly struct {
+	io.Writer
 }
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*RateLimitWriter)(nil)
+	_ http.Flusher        = (*RateLimitWriter)(nil)
+	_ http.Hijacker       = (*RateLimitWriter)(nil)
+	_ http.Pusher         = (*RateLimitWriter)(nil)
+	_ io.ReaderFrom       = (*RateLimitWriter)(nil)
+	_ io.Closer           = (*RateLimitWriter)(nil)
+)
@@ -0,0 +1,82 @@
+//go:build unix
+
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// processCPUTime 返回当前进程已使用的用户态和内核态CPU时间
+func processCPUTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// BenchmarkServeFile 比较file_server式的文件传输在不限速和经过限速写入器时每GB消耗的CPU。
+// 限速值足够大，测得的是限速路径本身的开销；客户端在同一进程中，两种情况的读取开销相同
+func BenchmarkServeFile(b *testing.B) {
+	const size = 64 << 20
+	name := filepath.Join(b.TempDir(), "file.bin")
+	f, err := os.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, "file.bin", time.Time{}, f)
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"plain": serve,
+		"throttled": func(w http.ResponseWriter, r *http.Request) {
+			rlw := NewRateLimitWriter(w, newTestChain(1<<40), TransferOptions{}, zap.NewNop())
+			serve(rlw, r)
+			rlw.Close()
+		},
+	}
+
+	for _, name := range []string{"plain", "throttled"} {
+		b.Run(name, func(b *testing.B) {
+			srv := httptest.NewServer(handlers[name])
+			defer srv.Close()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			cpu := processCPUTime(b)
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			cpu = processCPUTime(b) - cpu
+			b.ReportMetric(float64(cpu.Milliseconds())/(float64(b.N)*size/(1<<30)), "cpu-ms/GB")
+		})
+	}
+}
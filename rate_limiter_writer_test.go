@@ -0,0 +1,411 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestChain 创建只包含一个传输级令牌桶的令牌桶链
+func newTestChain(rate int64) *BucketChain {
+	chain := NewBucketChain()
+	chain.Add(ScopeTransfer, NewAtomicTokenBucket(rate, 1))
+	return chain
+}
+
+// newTestFile 在临时目录中创建指定大小的随机内容文件
+func newTestFile(t testing.TB, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i>>8)
+	}
+	name := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name, data
+}
+
+// readerFromRecorder 记录每次ReadFrom收到的读取器
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readers []io.Reader
+}
+
+func (rr *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	rr.readers = append(rr.readers, r)
+	return io.Copy(writerOnly{rr.ResponseRecorder}, r)
+}
+
+func TestReadFromUnwrapsLimitedReader(t *testing.T) {
+	name, data := newTestFile(t, 300*1024)
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rlw := NewRateLimitWriter(rec, newTestChain(1<<40), TransferOptions{}, zap.NewNop())
+
+	// 与http.ServeContent相同，通过io.CopyN传入*io.LimitedReader
+	const limit = 200*1024 + 123
+	n, err := io.CopyN(rlw, f, limit)
+	if err != nil || n != limit {
+		t.Fatalf("CopyN = %d, %v; want %d", n, err, limit)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[:limit]) {
+		t.Fatal("响应内容与文件不一致")
+	}
+	if len(rec.readers) == 0 {
+		t.Fatal("没有经过底层的ReadFrom")
+	}
+	for _, r := range rec.readers {
+		lr, ok := r.(*io.LimitedReader)
+		if !ok {
+			t.Fatalf("底层收到 %T，期望 *io.LimitedReader", r)
+		}
+		if _, ok := lr.R.(*os.File); !ok {
+			t.Fatalf("LimitedReader 包装的是 %T，期望 *os.File（只能有一层LimitedReader）", lr.R)
+		}
+	}
+
+	// 文件位置必须停在CopyN的边界上，后续读取才能继续
+	rest, _ := io.ReadAll(f)
+	if !bytes.Equal(rest, data[limit:]) {
+		t.Fatal("CopyN之后的文件位置不正确")
+	}
+}
+
+func TestReadFromStopsAtEOF(t *testing.T) {
+	_, data := newTestFile(t, 5000)
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rlw := NewRateLimitWriter(rec, newTestChain(1<<40), TransferOptions{}, zap.NewNop())
+
+	n, err := rlw.ReadFrom(bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("ReadFrom = %d, %v; want %d", n, err, len(data))
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatal("响应内容不一致")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d", rec.Code)
+	}
+}
+
+// testWrappers 是需要保持底层ResponseWriter可选接口的包装器
+var testWrappers = []struct {
+	name string
+	wrap func(w http.ResponseWriter) (http.ResponseWriter, func())
+}{
+	{"RateLimitWriter", func(w http.ResponseWriter) (http.ResponseWriter, func()) {
+		rlw := NewRateLimitWriter(w, newTestChain(1<<40), TransferOptions{CoalesceWrites: true}, zap.NewNop())
+		return rlw, func() { rlw.Close() }
+	}},
+	{"captureResponseWriter", func(w http.ResponseWriter) (http.ResponseWriter, func()) {
+		crw := newCaptureResponseWriter(w, func(http.Header) bool { return false })
+		return crw, func() { crw.finish() }
+	}},
+	{"RateLimitWriter/captureResponseWriter", func(w http.ResponseWriter) (http.ResponseWriter, func()) {
+		crw := newCaptureResponseWriter(w, func(http.Header) bool { return false })
+		rlw := NewRateLimitWriter(crw, newTestChain(1<<40), TransferOptions{CoalesceWrites: true}, zap.NewNop())
+		return rlw, func() { rlw.Close(); crw.finish() }
+	}},
+}
+
+func TestWriterInterfaces(t *testing.T) {
+	for _, wrapper := range testWrappers {
+		t.Run(wrapper.name, func(t *testing.T) {
+			t.Run("ResponseController", func(t *testing.T) {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w, done := wrapper.wrap(w)
+					defer done()
+					rc := http.NewResponseController(w)
+					deadline := time.Now().Add(time.Minute)
+					if err := rc.SetWriteDeadline(deadline); err != nil {
+						t.Errorf("SetWriteDeadline: %v", err)
+					}
+					if err := rc.SetReadDeadline(deadline); err != nil {
+						t.Errorf("SetReadDeadline: %v", err)
+					}
+					if err := rc.EnableFullDuplex(); err != nil {
+						t.Errorf("EnableFullDuplex: %v", err)
+					}
+					io.WriteString(w, "ok")
+				}))
+				defer srv.Close()
+				expectBody(t, srv.URL, "ok")
+			})
+
+			t.Run("Flusher", func(t *testing.T) {
+				flushed := make(chan struct{})
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w, done := wrapper.wrap(w)
+					defer done()
+					if _, ok := w.(http.Flusher); !ok {
+						t.Error("没有实现http.Flusher")
+					}
+					io.WriteString(w, "first")
+					if err := http.NewResponseController(w).Flush(); err != nil {
+						t.Errorf("Flush: %v", err)
+					}
+					// 客户端必须在处理器返回之前收到Flush的数据
+					select {
+					case <-flushed:
+					case <-time.After(5 * time.Second):
+						t.Error("Flush的数据没有到达客户端")
+					}
+					io.WriteString(w, "second")
+				}))
+				defer srv.Close()
+
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				buf := make([]byte, len("first"))
+				if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+					t.Fatalf("读取 %q, %v", buf, err)
+				}
+				close(flushed)
+				rest, _ := io.ReadAll(resp.Body)
+				if string(rest) != "second" {
+					t.Fatalf("剩余body = %q", rest)
+				}
+			})
+
+			t.Run("Hijacker", func(t *testing.T) {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w, done := wrapper.wrap(w)
+					defer done()
+					if _, ok := w.(http.Hijacker); !ok {
+						if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+							t.Error("既没有实现http.Hijacker也不能Unwrap")
+						}
+					}
+					conn, bufrw, err := http.NewResponseController(w).Hijack()
+					if err != nil {
+						t.Errorf("Hijack: %v", err)
+						return
+					}
+					defer conn.Close()
+					bufrw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+					bufrw.Flush()
+				}))
+				defer srv.Close()
+				expectBody(t, srv.URL, "hijacked")
+			})
+
+			t.Run("ReaderFrom", func(t *testing.T) {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w, done := wrapper.wrap(w)
+					defer done()
+					rf, ok := w.(io.ReaderFrom)
+					if !ok {
+						t.Error("没有实现io.ReaderFrom")
+						return
+					}
+					if _, err := rf.ReadFrom(bytes.NewReader([]byte("readfrom"))); err != nil {
+						t.Errorf("ReadFrom: %v", err)
+					}
+				}))
+				defer srv.Close()
+				expectBody(t, srv.URL, "readfrom")
+			})
+
+			t.Run("Pusher", func(t *testing.T) {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w, done := wrapper.wrap(w)
+					defer done()
+					pusher, ok := w.(http.Pusher)
+					if !ok {
+						t.Error("没有实现http.Pusher")
+						return
+					}
+					// HTTP/1.1不支持推送，包装器必须把底层的ErrNotSupported原样返回
+					if err := pusher.Push("/style.css", nil); !errors.Is(err, http.ErrNotSupported) {
+						t.Errorf("Push = %v, 期望 http.ErrNotSupported", err)
+					}
+					io.WriteString(w, "ok")
+				}))
+				defer srv.Close()
+				expectBody(t, srv.URL, "ok")
+			})
+		})
+	}
+}
+
+// expectBody 请求url并检查响应body
+func expectBody(t *testing.T, url, want string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != want {
+		t.Fatalf("body = %q, %v; 期望 %q", body, err, want)
+	}
+}
+
+func TestPacedChunksReachClient(t *testing.T) {
+	// 16KB/s时块大小为最小块大小1KB，每块间隔约62ms。
+	// 不Flush时数据在net/http的4KB缓冲区中积攒，客户端约每250ms才收到4KB
+	const (
+		rate  = 16 * 1024
+		chunk = defaultMinChunkSize
+		size  = 8 * chunk
+	)
+	name, data := newTestFile(t, size)
+	interval := time.Duration(float64(chunk) / rate * float64(time.Second))
+
+	for _, tc := range []struct {
+		name  string
+		write func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"Write", func(w http.ResponseWriter, _ *http.Request) {
+			w.Write(data)
+		}},
+		{"ReadFrom", func(w http.ResponseWriter, _ *http.Request) {
+			io.Copy(w, bytes.NewReader(data))
+		}},
+		{"ServeContent", func(w http.ResponseWriter, r *http.Request) {
+			f, err := os.Open(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			http.ServeContent(w, r, "file.bin", time.Time{}, f)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rlw := NewRateLimitWriter(w, newTestChain(rate), TransferOptions{}, zap.NewNop())
+				defer rlw.Close()
+				tc.write(rlw, r)
+			}))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var (
+				got      []byte
+				last     time.Time
+				maxGap   time.Duration
+				maxBurst int
+			)
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := resp.Body.Read(buf)
+				if n > 0 {
+					now := time.Now()
+					if !last.IsZero() {
+						maxGap = max(maxGap, now.Sub(last))
+					}
+					last = now
+					maxBurst = max(maxBurst, n)
+					got = append(got, buf[:n]...)
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("body长度 = %d, 期望 %d", len(got), len(data))
+			}
+			if maxBurst > 2*chunk {
+				t.Errorf("客户端一次收到 %d 字节，期望不超过 %d", maxBurst, 2*chunk)
+			}
+			if maxGap > 3*interval {
+				t.Errorf("两次到达的最大间隔 %v，期望不超过 %v", maxGap, 3*interval)
+			}
+		})
+	}
+}
+
+func TestChunkBufferClasses(t *testing.T) {
+	if 1<<maxBufferShift != maxChunkSize {
+		t.Fatalf("最大容量等级 %d 与maxChunkSize %d 不一致", 1<<maxBufferShift, maxChunkSize)
+	}
+	for _, tc := range []struct {
+		size, cap int
+	}{
+		{1, 1024},
+		{1024, 1024},
+		{1025, 2048},
+		{819, 1024},
+		{50 * 1024, 64 * 1024},
+		{maxChunkSize, maxChunkSize},
+	} {
+		buf := getChunkBuffer(tc.size)
+		if len(*buf) != 0 || cap(*buf) != tc.cap {
+			t.Errorf("getChunkBuffer(%d): len %d cap %d, 期望 len 0 cap %d", tc.size, len(*buf), cap(*buf), tc.cap)
+		}
+		*buf = append(*buf, 1)
+		putChunkBuffer(buf)
+	}
+}
+
+func TestCoalesceBufferFollowsChunkSize(t *testing.T) {
+	const rate = 16 * 1024
+	rec := httptest.NewRecorder()
+	chain := newTestChain(rate)
+	rlw := NewRateLimitWriter(rec, chain, TransferOptions{CoalesceWrites: true}, zap.NewNop())
+
+	var want []byte
+	write := func(n int) {
+		t.Helper()
+		b := bytes.Repeat([]byte{byte(len(want))}, n)
+		if _, err := rlw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, b...)
+	}
+
+	// 16KB/s时块大小为1KB，缓冲区只需要1KB
+	write(100)
+	if c := cap(*rlw.pending); c != 1024 {
+		t.Fatalf("合并缓冲区容量 = %d, 期望 1024", c)
+	}
+	write(500)
+
+	// 提速后块变大，已合并的数据搬到更大的缓冲区，并按新的块大小凑满再发送
+	chain.Limiter(ScopeTransfer).(*AtomicTokenBucket).SetRate(1 << 20)
+	chunk := rlw.chunkSize()
+	write(1000)
+	if c := cap(*rlw.pending); c < chunk {
+		t.Fatalf("合并缓冲区容量 = %d, 小于块大小 %d", c, chunk)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("未凑满一块就发送了 %d 字节", rec.Body.Len())
+	}
+	write(chunk)
+
+	if err := rlw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Fatalf("响应内容不一致：长度 %d, 期望 %d", rec.Body.Len(), len(want))
+	}
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// 速率爬升方式
+const (
+	RampLinear      = "linear"
+	RampExponential = "exponential"
+)
+
+// 速率爬升的起始速率下限（字节/秒）
+const minProfileRate = 1024
+
+// RateProfile 定义单次传输的速率曲线：开始时从低速爬升到目标速率，
+// 传输超过指定大小或时长后降到较低的速率
+type RateProfile struct {
+	// 爬升方式，linear或exponential，为空时不爬升
+	RampUp string `json:"ramp_up,omitempty"`
+
+	// 从起始速率爬升到目标速率所需的时间
+	RampUpDuration caddy.Duration `json:"ramp_up_duration,omitempty"`
+
+	// 传输超过该字节数后降速，0表示不按大小降速
+	RampDownAfterBytes int64 `json:"ramp_down_after_bytes,omitempty"`
+
+	// 传输超过该时长后降速，0表示不按时长降速
+	RampDownAfter caddy.Duration `json:"ramp_down_after,omitempty"`
+
+	// 降速后的速率（字节/秒）
+	RampDownRate int64 `json:"ramp_down_rate,omitempty"`
+}
+
+// Validate 检查速率曲线配置是否有效
+func (p *RateProfile) Validate() error {
+	switch p.RampUp {
+	case "", RampLinear, RampExponential:
+	default:
+		return fmt.Errorf("未知的爬升方式: %s", p.RampUp)
+	}
+	if p.RampUp != "" && p.RampUpDuration <= 0 {
+		return fmt.Errorf("ramp_up需要大于0的爬升时间")
+	}
+	if p.RampDownAfterBytes < 0 || p.RampDownAfter < 0 || p.RampDownRate < 0 {
+		return fmt.Errorf("降速参数不能为负数")
+	}
+	if (p.RampDownAfterBytes > 0 || p.RampDownAfter > 0) && p.RampDownRate <= 0 {
+		return fmt.Errorf("降速需要设置大于0的ramp_down_rate")
+	}
+	return nil
+}
+
+// RateAt 返回传输进行了elapsed时间、已发送sent字节时应使用的速率
+func (p *RateProfile) RateAt(target int64, elapsed time.Duration, sent int64) int64 {
+	// 降速优先于爬升，降速后的速率不会高于目标速率
+	if (p.RampDownAfterBytes > 0 && sent >= p.RampDownAfterBytes) ||
+		(p.RampDownAfter > 0 && elapsed >= time.Duration(p.RampDownAfter)) {
+		if p.RampDownRate < target {
+			return p.RampDownRate
+		}
+		return target
+	}
+
+	rampUp := time.Duration(p.RampUpDuration)
+	if p.RampUp == "" || rampUp <= 0 || elapsed >= rampUp {
+		return target
+	}
+
+	start := float64(target) / 100
+	if start < minProfileRate {
+		start = minProfileRate
+	}
+	if start >= float64(target) {
+		return target
+	}
+
+	progress := float64(elapsed) / float64(rampUp)
+	var rate float64
+	switch p.RampUp {
+	case RampExponential:
+		// 按指数曲线从起始速率增长到目标速率
+		rate = start * math.Pow(float64(target)/start, progress)
+	default:
+		rate = start + (float64(target)-start)*progress
+	}
+	return int64(rate)
+}
@@ -5,8 +5,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -16,13 +17,17 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-// 定义上下文键，用于在请求上下文中存储令牌桶
+// 定义上下文键，用于在请求上下文中存储令牌桶链
 type contextKey string
-const tokenBucketKey contextKey = "token_bucket"
+const (
+	bucketChainKey     contextKey = "bucket_chain"
+	transferOptionsKey contextKey = "transfer_options"
+)
 
 // 定义日志字段键，这些将在整个包中共享
 var (
 	logKeyUserID = "userID"
+	logKeyBucketKey = "bucketKey"
 	logKeyRate   = "rate"
 	logKeyOldRate = "oldRate"
 	logKeyNewRate = "newRate"
@@ -52,20 +57,139 @@ type RateLimit struct {
 	// 限速值响应头
 	HeaderRateLimit string `json:"header_rate_limit,omitempty"`
 
+	// 用户组ID响应头，例如组织ID
+	HeaderGroupID string `json:"header_group_id,omitempty"`
+
+	// 用户组限速值响应头
+	HeaderGroupRateLimit string `json:"header_group_rate_limit,omitempty"`
+
+	// 用户上限速率响应头，大于保证速率时允许借用空闲带宽
+	HeaderRateLimitCeil string `json:"header_rate_limit_ceil,omitempty"`
+
+	// 用户组上限速率响应头
+	HeaderGroupRateLimitCeil string `json:"header_group_rate_limit_ceil,omitempty"`
+
+	// 用户峰值速率响应头，用于双速率限速，X-Accel-RateLimit此时作为持续速率
+	HeaderPeakRateLimit string `json:"header_peak_rate_limit,omitempty"`
+
+	// 用户峰值突发容量（字节）响应头
+	HeaderPeakBurst string `json:"header_peak_burst,omitempty"`
+
+	// 用户承诺突发容量（字节）响应头
+	HeaderCommittedBurst string `json:"header_committed_burst,omitempty"`
+
+	// 全速发送字节数响应头，与nginx的limit_rate_after语义相同
+	HeaderLimitRateAfter string `json:"header_limit_rate_after,omitempty"`
+
+	// 单次传输限速值响应头
+	HeaderTransferRateLimit string `json:"header_transfer_rate_limit,omitempty"`
+
+	// nginx的单次传输限速响应头（字节/秒），0表示不限制单次传输的速率
+	HeaderLimitRate string `json:"header_limit_rate,omitempty"`
+
+	// nginx的缓冲开关响应头：no表示每块数据立即发送，yes表示合并小块写入
+	HeaderBuffering string `json:"header_buffering,omitempty"`
+
+	// nginx的缓存时间响应头：秒数、@Unix时间戳或off，转换为Cache-Control和Expires
+	HeaderExpires string `json:"header_expires,omitempty"`
+
+	// nginx的字符集响应头，追加到最终响应的Content-Type中
+	HeaderCharset string `json:"header_charset,omitempty"`
+
+	// 当前站点的全局限速值（字节/秒），0表示不限制
+	GlobalRateLimit int64 `json:"global_rate_limit,omitempty"`
+
+	// 响应头缺失时使用的默认峰值速率（字节/秒），0表示不启用双速率限速
+	PeakRateLimit int64 `json:"peak_rate_limit,omitempty"`
+
+	// 响应头缺失时使用的默认峰值突发容量（字节），0表示使用突发倍数
+	PeakBurst int64 `json:"peak_burst,omitempty"`
+
+	// 响应头缺失时使用的默认承诺突发容量（字节），0表示使用突发倍数
+	CommittedBurst int64 `json:"committed_burst,omitempty"`
+
+	// 响应头缺失时每次传输开头以全速发送的字节数
+	LimitRateAfter int64 `json:"limit_rate_after,omitempty"`
+
+	// 全速发送的字节是否仍计入令牌桶
+	CountRateAfter bool `json:"count_rate_after,omitempty"`
+
+	// 单次传输的速率曲线，如慢启动和超过阈值后降速
+	Profile *RateProfile `json:"rate_profile,omitempty"`
+
+	// 限速传输中两次写入之间允许客户端停滞的最长时间，每次写入前会将连接的
+	// 写超时推迟该时长。未设置时使用服务器的write_timeout
+	StallTimeout caddy.Duration `json:"stall_timeout,omitempty"`
+
+	// 客户端的最低接收速率（字节/秒），持续低于该速率超过stall_timeout时终止传输，
+	// 释放其占用的带宽份额。0表示不检测
+	MinClientRate int64 `json:"min_client_rate,omitempty"`
+
+	// 限速传输两次写入之间的目标间隔，块大小按速率×间隔计算，默认50ms
+	PacingInterval caddy.Duration `json:"pacing_interval,omitempty"`
+
+	// 限速传输的最小块大小（字节），默认1KB
+	MinChunkSize int `json:"min_chunk_size,omitempty"`
+
+	// 不合并限速传输中的小块写入，每次写入都单独等待令牌
+	DisableWriteCoalescing bool `json:"disable_write_coalescing,omitempty"`
+
+	// 限速传输等待令牌的方式：sleep（默认，每次等待使用运行时定时器）、
+	// wheel（由共享时间轮按5ms精度批量唤醒）
+	WaitScheduler string `json:"wait_scheduler,omitempty"`
+
+	// 识别的内部重定向响应头方言：x-accel、x-sendfile、x-lighttpd-send-file，默认只有x-accel
+	Dialects []string `json:"dialects,omitempty"`
+
+	// X-Sendfile类方言的文件系统根目录到URI前缀的映射
+	SendfileRoots []SendfileRoot `json:"sendfile_roots,omitempty"`
+
+	// 内部重定向时查询参数的处理方式：replace（默认，使用重定向URI中的查询参数）、
+	// preserve（保留原始请求的查询参数）、merge（合并两者）
+	RedirectQuery string `json:"redirect_query,omitempty"`
+
+	// 允许内部重定向到的路径前缀，为空时允许所有路径。
+	// 后端要求重定向到前缀之外的路径时返回502
+	AllowedPrefixes []string `json:"allowed_prefixes,omitempty"`
+
+	// nginx命名位置（不含@）到Caddy命名路由的映射，未映射的位置使用同名的命名路由
+	NamedLocations map[string]string `json:"named_locations,omitempty"`
+
+	// 内部重定向时携带到最终响应中的后端响应头，默认与nginx一致：
+	// Content-Type、Content-Disposition、Accept-Ranges、Set-Cookie、Cache-Control、Expires
+	CarryHeaders []string `json:"carry_headers,omitempty"`
+
+	// 携带响应头的模式：backend（默认，后端的值优先）、target（内部重定向目标的值优先）、off（不携带）
+	CarryHeadersMode string `json:"carry_headers_mode,omitempty"`
+
+	// 客户端请求中包含控制头时拒绝请求（400），默认直接删除这些头
+	RejectControlHeaders bool `json:"reject_control_headers,omitempty"`
+
+	// Range续传时沿用上一次传输令牌桶的最长空闲时间，默认10分钟
+	TransferResumeTTL caddy.Duration `json:"transfer_resume_ttl,omitempty"`
+
 	// 突发倍数，默认为1
 	BurstMultiplier float64 `json:"burst_multiplier,omitempty"`
 
+	// 各层级的突发倍数，默认与BurstMultiplier相同
+	TransferBurstMultiplier float64 `json:"transfer_burst_multiplier,omitempty"`
+	GroupBurstMultiplier    float64 `json:"group_burst_multiplier,omitempty"`
+	GlobalBurstMultiplier   float64 `json:"global_burst_multiplier,omitempty"`
+
 	// Redis连接字符串，如果为空则使用内存模式
 	Redis string `json:"redis,omitempty"`
 
 	// 内部状态
-	limiters      map[string]*TokenBucket
-	limitersMutex sync.RWMutex
+	limiters      *bucketRegistry
+	transfers     *transferRegistry
+	globalBucket  Limiter
 	storage       Storage
 	logger        *zap.Logger
 	cleanupTicker *time.Ticker
 	cleanupDone   chan struct{}
-	next          caddyhttp.Handler
+
+	// 需要从请求和响应中删除的控制头
+	controlHeaders []string
 }
 
 // CaddyModule 返回Caddy模块信息
@@ -79,7 +203,8 @@ func (RateLimit) CaddyModule() caddy.ModuleInfo {
 // Provision 实现caddy.Provisioner接口
 func (rl *RateLimit) Provision(ctx caddy.Context) error {
 	rl.logger = ctx.Logger(rl)
-	rl.limiters = make(map[string]*TokenBucket)
+	rl.limiters = newBucketRegistry()
+	rl.transfers = newTransferRegistry()
 	rl.cleanupDone = make(chan struct{})
 
 	// 设置默认值
@@ -89,9 +214,70 @@ func (rl *RateLimit) Provision(ctx caddy.Context) error {
 	if rl.HeaderRateLimit == "" {
 		rl.HeaderRateLimit = "X-Accel-RateLimit"
 	}
+	if rl.HeaderGroupID == "" {
+		rl.HeaderGroupID = "X-Accel-Group-ID"
+	}
+	if rl.HeaderGroupRateLimit == "" {
+		rl.HeaderGroupRateLimit = "X-Accel-Group-RateLimit"
+	}
+	if rl.HeaderRateLimitCeil == "" {
+		rl.HeaderRateLimitCeil = "X-Accel-RateLimit-Ceil"
+	}
+	if rl.HeaderGroupRateLimitCeil == "" {
+		rl.HeaderGroupRateLimitCeil = "X-Accel-Group-RateLimit-Ceil"
+	}
+	if rl.HeaderPeakRateLimit == "" {
+		rl.HeaderPeakRateLimit = "X-Accel-Peak-RateLimit"
+	}
+	if rl.HeaderPeakBurst == "" {
+		rl.HeaderPeakBurst = "X-Accel-Peak-Burst"
+	}
+	if rl.HeaderCommittedBurst == "" {
+		rl.HeaderCommittedBurst = "X-Accel-Committed-Burst"
+	}
+	if rl.HeaderLimitRateAfter == "" {
+		rl.HeaderLimitRateAfter = "X-Accel-Limit-Rate-After"
+	}
+	if rl.HeaderTransferRateLimit == "" {
+		rl.HeaderTransferRateLimit = "X-Accel-Transfer-RateLimit"
+	}
+	if rl.HeaderLimitRate == "" {
+		rl.HeaderLimitRate = "X-Accel-Limit-Rate"
+	}
+	if rl.HeaderBuffering == "" {
+		rl.HeaderBuffering = "X-Accel-Buffering"
+	}
+	if rl.HeaderExpires == "" {
+		rl.HeaderExpires = "X-Accel-Expires"
+	}
+	if rl.HeaderCharset == "" {
+		rl.HeaderCharset = "X-Accel-Charset"
+	}
+	if len(rl.Dialects) == 0 {
+		rl.Dialects = []string{DialectXAccel}
+	}
+	rl.controlHeaders = rl.controlHeaderNames()
+	if rl.CarryHeaders == nil {
+		rl.CarryHeaders = defaultCarryHeaders
+	}
+	if rl.CarryHeadersMode == "" {
+		rl.CarryHeadersMode = CarryBackend
+	}
+	if rl.TransferResumeTTL == 0 {
+		rl.TransferResumeTTL = caddy.Duration(defaultTransferResumeTTL)
+	}
 	if rl.BurstMultiplier <= 0 {
 		rl.BurstMultiplier = 1.0
 	}
+	if rl.TransferBurstMultiplier <= 0 {
+		rl.TransferBurstMultiplier = rl.BurstMultiplier
+	}
+	if rl.GroupBurstMultiplier <= 0 {
+		rl.GroupBurstMultiplier = rl.BurstMultiplier
+	}
+	if rl.GlobalBurstMultiplier <= 0 {
+		rl.GlobalBurstMultiplier = rl.BurstMultiplier
+	}
 
 	// 根据配置选择存储后端
 	var err error
@@ -105,6 +291,16 @@ func (rl *RateLimit) Provision(ctx caddy.Context) error {
 		return err
 	}
 
+	// 全局令牌桶不会被清理，在整个模块生命周期内共享。
+	// 只有Redis模式需要跨实例共享状态，内存模式使用无锁令牌桶
+	if rl.GlobalRateLimit > 0 {
+		if rl.Redis != "" {
+			rl.globalBucket = NewTokenBucket(rl.GlobalRateLimit, rl.storage, ScopeGlobal, rl.logger, rl.GlobalBurstMultiplier)
+		} else {
+			rl.globalBucket = NewAtomicTokenBucket(rl.GlobalRateLimit, rl.GlobalBurstMultiplier)
+		}
+	}
+
 	// 启动清理过期限速器的定时任务
 	rl.cleanupTicker = time.NewTicker(5 * time.Minute)
 	go rl.cleanupExpiredLimiters()
@@ -140,79 +336,182 @@ func (rl *RateLimit) Validate() error {
 	if rl.HeaderRateLimit == "" {
 		return fmt.Errorf("header_rate_limit不能为空")
 	}
+	if rl.GlobalRateLimit < 0 {
+		return fmt.Errorf("global_rate_limit不能为负数")
+	}
+	switch rl.CarryHeadersMode {
+	case CarryBackend, CarryTarget, CarryOff:
+	default:
+		return fmt.Errorf("未知的carry_headers_mode: %s", rl.CarryHeadersMode)
+	}
+	switch rl.WaitScheduler {
+	case "", WaitSleep, WaitWheel:
+	default:
+		return fmt.Errorf("未知的wait_scheduler: %s", rl.WaitScheduler)
+	}
+	switch rl.RedirectQuery {
+	case "", QueryReplace, QueryPreserve, QueryMerge:
+	default:
+		return fmt.Errorf("未知的redirect_query: %s", rl.RedirectQuery)
+	}
+	for _, prefix := range rl.AllowedPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("allowed_prefixes中的前缀必须以/开头: %s", prefix)
+		}
+	}
+	if err := rl.validateDialects(); err != nil {
+		return err
+	}
+	if rl.TransferResumeTTL < 0 {
+		return fmt.Errorf("transfer_resume_ttl不能为负数")
+	}
+	if rl.StallTimeout < 0 {
+		return fmt.Errorf("stall_timeout不能为负数")
+	}
+	if rl.PacingInterval < 0 || rl.MinChunkSize < 0 {
+		return fmt.Errorf("pacing_interval和min_chunk_size不能为负数")
+	}
+	if rl.MinClientRate < 0 {
+		return fmt.Errorf("min_client_rate不能为负数")
+	}
+	if rl.LimitRateAfter < 0 {
+		return fmt.Errorf("limit_rate_after不能为负数")
+	}
+	if rl.PeakRateLimit < 0 || rl.PeakBurst < 0 || rl.CommittedBurst < 0 {
+		return fmt.Errorf("peak_rate_limit、peak_burst和committed_burst不能为负数")
+	}
+	if rl.Profile != nil {
+		if err := rl.Profile.Validate(); err != nil {
+			return fmt.Errorf("无效的rate_profile: %v", err)
+		}
+	}
 	return nil
 }
 
 // ServeHTTP 实现caddyhttp.MiddlewareHandler接口
 // 这个方法现在负责处理响应头中的X-Accel-Redirect，并将令牌桶存储在请求上下文中
 func (rl *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	rl.next = next
+	// 模块实例被所有并发请求共享，后端处理和内部重定向使用的处理器
+	// 只能通过参数传递，不能保存在实例上
+	return rl.serveAccel(w, r, next, next)
+}
+
+// serveAccel 执行一次完整的X-Accel流程：由upstream处理请求并捕获响应，
+// 如果响应要求内部重定向，则构建带有令牌桶链的内部请求交给target处理。
+// 所有状态都保存在局部变量和内部请求的上下文中
+func (rl *RateLimit) serveAccel(w http.ResponseWriter, r *http.Request, upstream, target caddyhttp.Handler) error {
 	// 记录请求信息
 	rl.logger.Debug("处理请求", 
 		zap.String("method", r.Method), 
 		zap.String("path", r.URL.Path),
 		zap.String("remoteAddr", r.RemoteAddr))
 
-	// 创建一个响应捕获器，用于拦截和检查响应头
-	crw := &captureResponseWriter{
-		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
-		statusCode:            http.StatusOK,
-		header:                make(http.Header),
+	// 客户端不能伪造控制头，发给客户端的响应中也不能带有控制头
+	if err := rl.scrubRequest(r); err != nil {
+		return err
+	}
+	w = newScrubWriter(w, rl.controlHeaders)
+
+	// 创建一个响应捕获器，缓冲响应头直到第一次写入或响应结束，
+	// 再根据是否为X-Accel响应决定原样转发还是执行内部重定向
+	crw := newCaptureResponseWriter(w, rl.isAccelResponse)
+	crw.forward = func(w http.ResponseWriter, header http.Header) http.ResponseWriter {
+		return rl.passThrough(r, w, header)
 	}
 
 	// 处理请求，捕获响应
-	err := next.ServeHTTP(crw, r)
+	err := upstream.ServeHTTP(crw, r)
 	if err != nil {
 		rl.logger.Error("处理请求失败", zap.Error(err))
 		return err
 	}
 
-	// 检查必要的头信息是否都存在
-	accelRedirect := crw.Header().Get("X-Accel-Redirect")
-	userID := crw.Header().Get(rl.HeaderUserID)
-	rateLimitStr := crw.Header().Get(rl.HeaderRateLimit)
-	
-	// 如果任何必要的头信息缺失，则跳过限速处理，但仍需处理内部重定向
-	if accelRedirect == "" {
-		// 如果没有 X-Accel-Redirect 头，直接返回原始响应
+	// 没有写入body的响应（如302、304、403）在这里把状态码和响应头转发给客户端
+	if err := crw.finish(); err != nil {
+		return err
+	}
+
+	// 如果不是X-Accel响应，原始响应已经原样转发
+	if !crw.accel {
 		return nil
 	}
-	
-	// 创建一个新的请求，用于内部重定向
-	ctx := r.Context()
-	
-	// 只有当所有必要的限速信息都存在时，才应用限速
-	if userID != "" && rateLimitStr != "" {
-		// 解析限速值
-		rateLimit, err := strconv.ParseInt(rateLimitStr, 10, 64)
-		if err != nil {
-			rl.logger.Warn("解析限速值失败", zap.String("value", rateLimitStr), zap.Error(err))
-		} else {
-			// 使用条件日志记录限速参数
-			if rl.logger.Core().Enabled(zapcore.DebugLevel) {
-				rl.logger.Debug("获取限速参数", 
-					zap.String(logKeyUserID, userID), 
-					zap.Int64(logKeyRate, rateLimit),
-					zap.String("redirect", accelRedirect))
-			}
-			
-			// 获取或创建令牌桶
-			bucket, err := rl.getOrCreateBucket(userID, rateLimit)
-			if err != nil {
-				rl.logger.Error("获取令牌桶失败", zap.Error(err))
-			} else {
-				// 将令牌桶存储在请求上下文中，供后续中间件使用
-				ctx = context.WithValue(ctx, tokenBucketKey, bucket)
-			}
+	dialect, value := rl.redirectHeader(crw.Header())
+	accelRedirect, err := rl.redirectTarget(dialect, value)
+	if err != nil {
+		rl.logger.Error("无法解析内部重定向目标", zap.String("dialect", dialect), zap.Error(err))
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+
+	// 命名位置交给对应的命名路由处理
+	handler := target
+	if location, ok := namedLocation(accelRedirect); ok {
+		if handler, err = rl.namedRoute(r, location, target); err != nil {
+			rl.logger.Error("无法执行命名位置", zap.String("redirect", accelRedirect), zap.Error(err))
+			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
-	} else {
-		// 记录缺少限速信息的情况
+	}
+
+	req, err := rl.redirectRequest(r, crw.Header(), accelRedirect)
+	if err != nil {
+		rl.logger.Error("后端要求的内部重定向目标无效或不被允许",
+			zap.String("redirect", accelRedirect),
+			zap.String("path", r.URL.Path),
+			zap.String("remoteAddr", r.RemoteAddr),
+			zap.Error(err))
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+
+	// 执行内部重定向，并把允许的后端响应头和nginx响应头的效果带到最终响应中。
+	// 限速的传输由限速写入器处理X-Accel-Buffering，不限速时在这里处理
+	out := rl.carryHeaders(w, crw.Header())
+	if GetBucketChainFromContext(req) == nil && rl.unbuffered(crw.Header()) {
+		out = newFlushWriter(out)
+	}
+	return handler.ServeHTTP(out, req)
+}
+
+// isAccelResponse 判断后端响应是否要求内部重定向
+func (rl *RateLimit) isAccelResponse(header http.Header) bool {
+	dialect, _ := rl.redirectHeader(header)
+	return dialect != ""
+}
+
+// redirectRequest 创建内部重定向请求。令牌桶链和传输选项存储在新请求的上下文中，
+// 只对这一个请求可见
+func (rl *RateLimit) redirectRequest(r *http.Request, header http.Header, accelRedirect string) (*http.Request, error) {
+	// 标记请求由内部重定向产生，供rate_limit_internal判断
+	ctx := withInternalRedirect(r.Context())
+
+	// 命名位置保留原始请求的URI，其他目标解析为新的URL
+	var u *url.URL
+	if _, named := namedLocation(accelRedirect); !named {
+		var err error
+		if u, err = rl.redirectURL(r, accelRedirect); err != nil {
+			return nil, err
+		}
+	}
+	
+	// 根据响应头构建令牌桶链，只要有任意一级限速就应用限速
+	target := r.URL.Path
+	if u != nil {
+		target = u.Path
+	}
+	chain, transfer := rl.buildBucketChain(r, header, target)
+	if chain.Len() > 0 {
 		if rl.logger.Core().Enabled(zapcore.DebugLevel) {
-			rl.logger.Debug("缺少限速信息，仅执行内部重定向", 
-				zap.String("path", accelRedirect),
-				zap.Bool("missingUserID", userID == ""),
-				zap.Bool("missingRateLimit", rateLimitStr == ""))
+			rl.logger.Debug("获取限速参数", 
+				zap.Strings("scopes", chain.Scopes()),
+				zap.Int64(logKeyRate, chain.Rate()),
+				zap.String("redirect", accelRedirect))
 		}
+		// 将令牌桶链和传输选项存储在请求上下文中，供后续中间件使用
+		ctx = context.WithValue(ctx, bucketChainKey, chain)
+		opts := rl.transferOptions(r, header)
+		opts.transfer = transfer
+		ctx = context.WithValue(ctx, transferOptionsKey, opts)
+	} else if rl.logger.Core().Enabled(zapcore.DebugLevel) {
+		// 记录缺少限速信息的情况
+		rl.logger.Debug("缺少限速信息，仅执行内部重定向", zap.String("path", accelRedirect))
 	}
 	
 	// 执行内部重定向
@@ -222,63 +521,235 @@ func (rl *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 	
 	// 创建一个新的请求，保留原始请求的上下文（包含令牌桶）
 	newReq := r.Clone(ctx)
-	newReq.URL.Path = accelRedirect
-	newReq.URL.RawPath = ""
-	newReq.RequestURI = accelRedirect
-	
-	// 执行内部重定向
-	return rl.next.ServeHTTP(w, newReq)
+
+	// 与nginx一致，内部请求使用GET方法（HEAD保持不变），并去掉原始请求的body。
+	// Range和条件请求头原样保留，由目标处理器返回206、304等响应
+	if newReq.Method != http.MethodHead {
+		newReq.Method = http.MethodGet
+	}
+	newReq.Body = http.NoBody
+	newReq.GetBody = nil
+	newReq.ContentLength = 0
+	newReq.TransferEncoding = nil
+	for _, name := range []string{"Content-Length", "Content-Type", "Transfer-Encoding", "Expect"} {
+		newReq.Header.Del(name)
+	}
+	if u != nil {
+		newReq.URL = u
+		newReq.RequestURI = u.RequestURI()
+	}
+	return newReq, nil
 }
 
-// 获取或创建令牌桶
-func (rl *RateLimit) getOrCreateBucket(userID string, rateLimit int64) (*TokenBucket, error) {
-	rl.limitersMutex.RLock()
-	bucket, exists := rl.limiters[userID]
-	rl.limitersMutex.RUnlock()
-
-	if exists {
-		// 如果限速值变化，更新令牌桶
-		if bucket.Rate() != rateLimit {
-			oldRate := bucket.Rate()
-			bucket.SetRate(rateLimit)
-			
-			// 使用条件日志
-			if rl.logger.Core().Enabled(zapcore.DebugLevel) {
-				rl.logger.Debug("更新令牌桶速率", 
-					zap.String(logKeyUserID, userID), 
-					zap.Int64(logKeyOldRate, oldRate), 
-					zap.Int64(logKeyNewRate, rateLimit))
-			}
+// buildBucketChain 根据后端响应头构建令牌桶链，顺序为传输、用户、用户组、全局。
+// target是内部重定向的路径，用于在Range续传时找回传输状态。没有传输级令牌桶时返回的传输状态为nil
+func (rl *RateLimit) buildBucketChain(r *http.Request, header http.Header, target string) (*BucketChain, *transferState) {
+	chain := rl.sharedBucketChain(header)
+
+	// 启用速率曲线时需要一个传输级令牌桶来承载每次传输的速率变化，
+	// 没有指定传输速率时以其他层级的有效速率作为目标速率
+	rate, ok := rl.parseRate(header, rl.HeaderTransferRateLimit)
+	if !ok {
+		// nginx的X-Accel-Limit-Rate为0时不限制单次传输的速率
+		if rate, ok = rl.parseLimitRate(header); ok && rate == 0 {
+			return chain, nil
 		}
-		return bucket, nil
+	}
+	if !ok && rl.Profile != nil && chain.Len() > 0 {
+		rate, ok = chain.Rate(), true
+	}
+	if !ok {
+		return chain, nil
+	}
+
+	// 单次传输的令牌桶不需要存储后端，只在Range续传时沿用
+	transfer := rl.transfer(r, header, target, rate)
+	chain.Prepend(ScopeTransfer, transfer.bucket)
+	return chain, transfer
+}
+
+// sharedBucketChain 构建由多个请求共享的用户、用户组和全局层级
+func (rl *RateLimit) sharedBucketChain(header http.Header) *BucketChain {
+	chain := NewBucketChain()
+
+	userBucket, userCeil := rl.levelBuckets(header, ScopeUser, rl.HeaderUserID, rl.HeaderRateLimit, rl.HeaderRateLimitCeil, rl.BurstMultiplier)
+	groupBucket, groupCeil := rl.levelBuckets(header, ScopeGroup, rl.HeaderGroupID, rl.HeaderGroupRateLimit, rl.HeaderGroupRateLimitCeil, rl.GroupBurstMultiplier)
+
+	// 没有上限速率时各层级独立限速
+	if userCeil == nil && groupCeil == nil {
+		if userBucket != nil {
+			chain.Add(ScopeUser, rl.dualRate(header, userBucket, userBucket))
+		}
+		if groupBucket != nil {
+			chain.Add(ScopeGroup, groupBucket)
+		}
+		if rl.globalBucket != nil {
+			chain.Add(ScopeGlobal, rl.globalBucket)
+		}
+		return chain
 	}
 
-	// 创建新的令牌桶
-	rl.limitersMutex.Lock()
-	defer rl.limitersMutex.Unlock()
-
-	// 双重检查，避免并发创建
-	if bucket, exists = rl.limiters[userID]; exists {
-		if bucket.Rate() != rateLimit {
-			oldRate := bucket.Rate()
-			bucket.SetRate(rateLimit)
-			
-			// 使用条件日志
-			if rl.logger.Core().Enabled(zapcore.DebugLevel) {
-				rl.logger.Debug("并发更新令牌桶速率", 
-					zap.String(logKeyUserID, userID), 
-					zap.Int64(logKeyOldRate, oldRate), 
-					zap.Int64(logKeyNewRate, rateLimit))
-			}
+	// HTB模式：从全局到最细的借用层级构建类树。只有最细的类加入链中，
+	// 祖先类通过借用关系生效，否则祖先的硬限速会使借用失去意义
+	var parent *HTBClass
+	if rl.globalBucket != nil {
+		parent = NewHTBClass(rl.globalBucket, nil, nil)
+	}
+	if groupBucket != nil {
+		parent = NewHTBClass(groupBucket, groupCeil, parent)
+	}
+	if userCeil != nil {
+		chain.Add(ScopeUser, rl.dualRate(header, userBucket, NewHTBClass(userBucket, userCeil, parent)))
+	} else {
+		if userBucket != nil {
+			chain.Add(ScopeUser, rl.dualRate(header, userBucket, userBucket))
 		}
+		chain.Add(ScopeGroup, parent)
+	}
+
+	return chain
+}
+
+// levelBuckets 获取某一层级的保证速率令牌桶和上限速率令牌桶，
+// 缺少ID或速率时返回nil，上限速率不高于保证速率时忽略上限
+func (rl *RateLimit) levelBuckets(header http.Header, scope, idHeader, rateHeader, ceilHeader string, burstMultiplier float64) (SharedLimiter, SharedLimiter) {
+	id := header.Get(idHeader)
+	if id == "" {
+		return nil, nil
+	}
+	rate, ok := rl.parseRate(header, rateHeader)
+	if !ok {
+		return nil, nil
+	}
+
+	key := scope + ":" + id
+	bucket := rl.getOrCreateBucket(key, rate, burstMultiplier)
+
+	ceil, ok := rl.parseRate(header, ceilHeader)
+	if !ok || ceil <= rate {
 		return bucket, nil
 	}
+	return bucket, rl.getOrCreateBucket(key+":ceil", ceil, burstMultiplier)
+}
 
-	// 创建新的令牌桶
-	bucket = NewTokenBucket(rateLimit, rl.storage, userID, rl.logger, rl.BurstMultiplier)
-	rl.limiters[userID] = bucket
-	
-	return bucket, nil
+// transferOptions 根据后端响应头和配置生成单次传输的选项
+func (rl *RateLimit) transferOptions(r *http.Request, header http.Header) TransferOptions {
+	opts := TransferOptions{
+		RateAfter:      rl.LimitRateAfter,
+		CountRateAfter: rl.CountRateAfter,
+		Profile:        rl.Profile,
+		StallTimeout:   time.Duration(rl.StallTimeout),
+		MinClientRate:  rl.MinClientRate,
+		PacingInterval: time.Duration(rl.PacingInterval),
+		MinChunkSize:   rl.MinChunkSize,
+		CoalesceWrites: !rl.DisableWriteCoalescing,
+		SharedWheel:    rl.WaitScheduler == WaitWheel,
+		ControlHeaders: rl.controlHeaders,
+	}
+
+	// 未配置stall_timeout时沿用服务器的write_timeout，使其按写入进度而不是整个响应计算
+	if opts.StallTimeout == 0 {
+		if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+			opts.StallTimeout = time.Duration(srv.WriteTimeout)
+		}
+	}
+	// nginx的X-Accel-Buffering：关闭缓冲时每块数据立即发送给客户端
+	if rl.unbuffered(header) {
+		opts.CoalesceWrites = false
+		opts.FlushWrites = true
+	} else if strings.EqualFold(header.Get(rl.HeaderBuffering), "yes") {
+		opts.CoalesceWrites = true
+	}
+	if value := header.Get(rl.HeaderLimitRateAfter); value != "" {
+		rateAfter, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rateAfter < 0 {
+			rl.logger.Warn("解析全速发送字节数失败", zap.String("value", value), zap.Error(err))
+		} else {
+			opts.RateAfter = rateAfter
+		}
+	}
+	return opts
+}
+
+// dualRate 为用户的承诺桶应用承诺突发容量，并在峰值速率高于持续速率时
+// 附加峰值桶组成双速率限速器，否则原样返回committed
+func (rl *RateLimit) dualRate(header http.Header, bucket SharedLimiter, committed Limiter) Limiter {
+	if burst, ok := rl.parseRateOr(header, rl.HeaderCommittedBurst, rl.CommittedBurst); ok {
+		bucket.SetBurst(burst)
+	}
+
+	peakRate, ok := rl.parseRateOr(header, rl.HeaderPeakRateLimit, rl.PeakRateLimit)
+	if !ok || peakRate <= bucket.Rate() {
+		return committed
+	}
+
+	peak := rl.getOrCreateBucket(ScopeUser+":"+header.Get(rl.HeaderUserID)+":peak", peakRate, rl.BurstMultiplier)
+	if burst, ok := rl.parseRateOr(header, rl.HeaderPeakBurst, rl.PeakBurst); ok {
+		peak.SetBurst(burst)
+	}
+	return NewDualRateBucket(peak, committed)
+}
+
+// parseRateOr 解析响应头中的数值，响应头缺失时使用配置的默认值
+func (rl *RateLimit) parseRateOr(header http.Header, name string, fallback int64) (int64, bool) {
+	if header.Get(name) == "" {
+		return fallback, fallback > 0
+	}
+	return rl.parseRate(header, name)
+}
+
+// parseLimitRate 解析nginx的X-Accel-Limit-Rate，与nginx一致0表示不限制
+func (rl *RateLimit) parseLimitRate(header http.Header) (int64, bool) {
+	value := header.Get(rl.HeaderLimitRate)
+	if value == "" {
+		return 0, false
+	}
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate < 0 {
+		rl.logger.Warn("解析限速值失败", zap.String("header", rl.HeaderLimitRate), zap.String("value", value), zap.Error(err))
+		return 0, false
+	}
+	return rate, true
+}
+
+// parseRate 解析响应头中的限速值，缺失或无效时返回false
+func (rl *RateLimit) parseRate(header http.Header, name string) (int64, bool) {
+	value := header.Get(name)
+	if value == "" {
+		return 0, false
+	}
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate <= 0 {
+		rl.logger.Warn("解析限速值失败", zap.String("header", name), zap.String("value", value), zap.Error(err))
+		return 0, false
+	}
+	return rate, true
+}
+
+// 获取或创建令牌桶。与全局令牌桶相同，只有Redis模式需要存储后端，内存模式使用无锁令牌桶
+func (rl *RateLimit) getOrCreateBucket(key string, rateLimit int64, burstMultiplier float64) SharedLimiter {
+	bucket, created := rl.limiters.getOrCreate(key, func() SharedLimiter {
+		if rl.Redis != "" {
+			return NewTokenBucket(rateLimit, rl.storage, key, rl.logger, burstMultiplier)
+		}
+		return NewAtomicTokenBucket(rateLimit, burstMultiplier)
+	})
+
+	// 如果限速值变化，更新令牌桶
+	if !created && bucket.Rate() != rateLimit {
+		oldRate := bucket.Rate()
+		bucket.SetRate(rateLimit)
+		
+		// 使用条件日志
+		if rl.logger.Core().Enabled(zapcore.DebugLevel) {
+			rl.logger.Debug("更新令牌桶速率", 
+				zap.String(logKeyBucketKey, key), 
+				zap.Int64(logKeyOldRate, oldRate), 
+				zap.Int64(logKeyNewRate, rateLimit))
+		}
+	}
+
+	return bucket
 }
 
 // 清理过期的限速器
@@ -286,57 +757,52 @@ func (rl *RateLimit) cleanupExpiredLimiters() {
 	for {
 		select {
 		case <-rl.cleanupTicker.C:
-			rl.limitersMutex.Lock()
-			for userID, bucket := range rl.limiters {
-				if time.Since(bucket.LastAccess()) > 30*time.Minute {
-					delete(rl.limiters, userID)
-					
-					// 使用条件日志
-					if rl.logger.Core().Enabled(zapcore.DebugLevel) {
-						rl.logger.Debug("清理过期令牌桶", zap.String(logKeyUserID, userID))
-					}
+			rl.transfers.sweep(time.Duration(rl.TransferResumeTTL))
+			rl.limiters.sweep(30*time.Minute, func(key string) {
+				// 使用条件日志
+				if rl.logger.Core().Enabled(zapcore.DebugLevel) {
+					rl.logger.Debug("清理过期令牌桶", zap.String(logKeyBucketKey, key))
 				}
-			}
-			rl.limitersMutex.Unlock()
+			})
 		case <-rl.cleanupDone:
 			return
 		}
 	}
 }
 
-// captureResponseWriter 是一个响应写入器包装器，用于捕获响应头和状态码
-type captureResponseWriter struct {
-	*caddyhttp.ResponseWriterWrapper
-	statusCode int
-	header     http.Header
-	wroteHeader bool
-}
-
-// WriteHeader 实现http.ResponseWriter接口
-func (crw *captureResponseWriter) WriteHeader(statusCode int) {
-	if !crw.wroteHeader {
-		crw.statusCode = statusCode
-		crw.wroteHeader = true
+// GetBucketChainFromContext 从请求上下文中获取令牌桶链
+func GetBucketChainFromContext(r *http.Request) *BucketChain {
+	if chain, ok := r.Context().Value(bucketChainKey).(*BucketChain); ok {
+		return chain
 	}
+	return nil
 }
 
-// Header 实现http.ResponseWriter接口
-func (crw *captureResponseWriter) Header() http.Header {
-	return crw.header
+// GetTransferOptionsFromContext 从请求上下文中获取单次传输的选项
+func GetTransferOptionsFromContext(r *http.Request) TransferOptions {
+	if opts, ok := r.Context().Value(transferOptionsKey).(TransferOptions); ok {
+		return opts
+	}
+	return TransferOptions{}
 }
 
-// Write 实现http.ResponseWriter接口
-func (crw *captureResponseWriter) Write(b []byte) (int, error) {
-	if !crw.wroteHeader {
-		crw.WriteHeader(http.StatusOK)
+// GetTokenBucketFromContext 从请求上下文中获取用户级令牌桶
+func GetTokenBucketFromContext(r *http.Request) SharedLimiter {
+	if chain := GetBucketChainFromContext(r); chain != nil {
+		return baseBucket(chain.Limiter(ScopeUser))
 	}
-	return crw.ResponseWriter.Write(b)
+	return nil
 }
 
-// GetTokenBucketFromContext 从请求上下文中获取令牌桶
-func GetTokenBucketFromContext(r *http.Request) *TokenBucket {
-	if bucket, ok := r.Context().Value(tokenBucketKey).(*TokenBucket); ok {
-		return bucket
+// baseBucket 返回限速器中保存保证速率的令牌桶
+func baseBucket(limiter Limiter) SharedLimiter {
+	switch l := limiter.(type) {
+	case SharedLimiter:
+		return l
+	case *HTBClass:
+		return baseBucket(l.rate)
+	case *DualRateBucket:
+		return baseBucket(l.committed)
 	}
 	return nil
 }
@@ -0,0 +1,455 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newTestRateLimit 初始化并校验限速模块，测试结束时清理
+func newTestRateLimit(t testing.TB, rl *RateLimit) *RateLimit {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := rl.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rl.logger = zap.NewNop()
+	if err := rl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.Cleanup() })
+	return rl
+}
+
+// newTestServer 启动一个由handler处理请求的测试服务器，handler返回的错误按Caddy的方式转换为状态码
+func newTestServer(t testing.TB, handler caddyhttp.MiddlewareHandler, next caddyhttp.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := handler.ServeHTTP(w, r, next); err != nil {
+			status := http.StatusInternalServerError
+			var he caddyhttp.HandlerError
+			if errors.As(err, &he) {
+				status = he.StatusCode
+			}
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testRate 返回测试用户的限速值，每个用户不同，用于确认请求拿到的是自己的令牌桶
+func testRate(user int) int64 {
+	return 1<<20 + int64(user)
+}
+
+func TestConcurrentRedirectsDoNotLeak(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{})
+
+	const (
+		clients  = 64
+		requests = 8
+		users    = 10
+	)
+
+	// next同时扮演后端和内部重定向的目标：原始请求返回X-Accel响应，
+	// 内部请求检查自己看到的用户令牌桶，并返回路径和速率
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			req := r.URL.Query().Get("req")
+			user, _ := strconv.Atoi(r.URL.Query().Get("user"))
+			w.Header().Set("X-Accel-Redirect", "/files/"+req)
+			w.Header().Set("X-Accel-User-ID", strconv.Itoa(user))
+			w.Header().Set("X-Accel-RateLimit", strconv.FormatInt(testRate(user), 10))
+			return nil
+		}
+		bucket := GetTokenBucketFromContext(r)
+		if bucket == nil {
+			return fmt.Errorf("内部请求 %s 没有令牌桶", r.URL.Path)
+		}
+		req, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/files/"))
+		if registered, _ := rl.limiters.get(ScopeUser + ":" + strconv.Itoa(req%users)); bucket != registered {
+			return fmt.Errorf("内部请求 %s 使用了其他用户的令牌桶", r.URL.Path)
+		}
+		_, err := fmt.Fprintf(w, "%s|%d", r.URL.Path, bucket.Rate())
+		return err
+	})
+	srv := newTestServer(t, rl, next)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*requests)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				req := c*requests + i
+				user := req % users
+				resp, err := http.Get(fmt.Sprintf("%s/download?req=%d&user=%d", srv.URL, req, user))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				want := fmt.Sprintf("/files/%d|%d", req, testRate(user))
+				if resp.StatusCode != http.StatusOK || string(body) != want {
+					errs <- fmt.Errorf("请求 %d: 状态码 %d, body %q, 期望 %q", req, resp.StatusCode, body, want)
+				}
+				if redirect := resp.Header.Get("X-Accel-Redirect"); redirect != "" {
+					errs <- fmt.Errorf("请求 %d: 控制头泄露给客户端: %s", req, redirect)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRegistryBucketsInMemoryMode(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{})
+	header := http.Header{
+		"X-Accel-User-Id":         {"1"},
+		"X-Accel-Ratelimit":       {"1000"},
+		"X-Accel-Ratelimit-Ceil":  {"4000"},
+		"X-Accel-Group-Id":        {"org"},
+		"X-Accel-Group-Ratelimit": {"8000"},
+		"X-Accel-Peak-Ratelimit":  {"2000"},
+		"X-Accel-Peak-Burst":      {"500"},
+	}
+	rl.sharedBucketChain(header)
+
+	// 内存模式下用户、上限、峰值和用户组令牌桶都使用无锁令牌桶
+	for _, key := range []string{"user:1", "user:1:ceil", "user:1:peak", "group:org"} {
+		bucket, ok := rl.limiters.get(key)
+		if !ok {
+			t.Fatalf("注册表中没有 %s", key)
+		}
+		if _, ok := bucket.(*AtomicTokenBucket); !ok {
+			t.Errorf("%s 的类型为 %T, 期望 *AtomicTokenBucket", key, bucket)
+		}
+	}
+	if peak, _ := rl.limiters.get("user:1:peak"); peak.Burst() != 500 {
+		t.Errorf("峰值桶的突发容量为 %d, 期望500", peak.Burst())
+	}
+
+	// 速率变化时更新已有的令牌桶
+	header.Set("X-Accel-Ratelimit", "3000")
+	rl.sharedBucketChain(header)
+	if user, _ := rl.limiters.get("user:1"); user.Rate() != 3000 {
+		t.Errorf("用户令牌桶的速率为 %d, 期望3000", user.Rate())
+	}
+
+	// 回满后空闲超过maxIdle的令牌桶被清理，仍有欠债的不会被清理
+	busy, _ := rl.limiters.get("group:org")
+	for _, key := range []string{"user:1", "user:1:ceil", "user:1:peak"} {
+		bucket, _ := rl.limiters.get(key)
+		bucket.Consume(-bucket.Burst())
+	}
+	time.Sleep(10 * time.Millisecond)
+	var deleted []string
+	rl.limiters.sweep(5*time.Millisecond, func(key string) { deleted = append(deleted, key) })
+	if len(deleted) != 3 {
+		t.Errorf("清理了 %v, 期望清理用户的3个令牌桶", deleted)
+	}
+	if bucket, ok := rl.limiters.get("group:org"); !ok || bucket != busy {
+		t.Error("仍有欠债的用户组令牌桶被清理")
+	}
+}
+
+func TestPassThroughNonAccelResponses(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case "/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			w.Header().Set("Trailer", "Grpc-Status")
+			io.WriteString(w, "body")
+			// 与reverse_proxy相同，trailer在body之后写入Header()
+			w.Header().Set("Grpc-Status", "0")
+		}
+		return nil
+	})
+	srv := newTestServer(t, rl, next)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		check  func(*http.Response, string) error
+	}{
+		{"/redirect", http.StatusFound, func(resp *http.Response, _ string) error {
+			if loc := resp.Header.Get("Location"); loc != "/login" {
+				return fmt.Errorf("Location = %q", loc)
+			}
+			return nil
+		}},
+		{"/forbidden", http.StatusForbidden, func(_ *http.Response, body string) error {
+			if body != "forbidden\n" {
+				return fmt.Errorf("body = %q", body)
+			}
+			return nil
+		}},
+		{"/stream", http.StatusOK, func(resp *http.Response, body string) error {
+			if body != "body" || resp.Trailer.Get("Grpc-Status") != "0" {
+				return fmt.Errorf("body = %q, trailer = %v", body, resp.Trailer)
+			}
+			return nil
+		}},
+	} {
+		resp, err := client.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: 状态码 = %d, 期望 %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if err := tc.check(resp, string(body)); err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+		}
+	}
+}
+
+// newTestFileServer 启动一个测试服务器：原始请求由后端返回指向name的X-Accel-Redirect，
+// 内部请求经过RateLimitInterceptor后由http.ServeContent发送文件。
+// header设置后端额外返回的响应头，served在每次内部请求结束后以请求的令牌桶链调用
+func newTestFileServer(t *testing.T, rl *RateLimit, name string, header http.Header, served func(*BucketChain)) *httptest.Server {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interceptor := &RateLimitInterceptor{logger: zap.NewNop()}
+	serve := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if _, ok := w.(*RateLimitWriter); !ok {
+			return fmt.Errorf("内部请求的写入器是 %T，期望 *RateLimitWriter", w)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		http.ServeContent(w, r, filepath.Base(name), info.ModTime(), f)
+		return nil
+	})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.Header().Set("X-Accel-Redirect", "/files/"+filepath.Base(name))
+			return nil
+		}
+		err := interceptor.ServeHTTP(w, r, serve)
+		if served != nil {
+			served(GetBucketChainFromContext(r))
+		}
+		return err
+	})
+	return newTestServer(t, rl, next)
+}
+
+func TestServeContentThroughRateLimitWriter(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{})
+	name, data := newTestFile(t, 64*1024)
+	info, _ := os.Stat(name)
+	srv := newTestFileServer(t, rl, name, http.Header{
+		"X-Accel-User-Id":   {"1"},
+		"X-Accel-Ratelimit": {strconv.Itoa(16 << 20)},
+	}, nil)
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		header  http.Header
+		status  int
+		body    []byte
+		headers map[string]string
+	}{
+		{
+			name:   "Range",
+			method: http.MethodGet,
+			header: http.Header{"Range": {"bytes=1000-4999"}},
+			status: http.StatusPartialContent,
+			body:   data[1000:5000],
+			headers: map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes 1000-4999/%d", len(data)),
+				"Content-Length": "4000",
+			},
+		},
+		{
+			name:   "NotModified",
+			method: http.MethodGet,
+			header: http.Header{"If-Modified-Since": {info.ModTime().UTC().Format(http.TimeFormat)}},
+			status: http.StatusNotModified,
+			body:   []byte{},
+		},
+		{
+			name:    "HEAD",
+			method:  http.MethodHead,
+			status:  http.StatusOK,
+			body:    []byte{},
+			headers: map[string]string{"Content-Length": strconv.Itoa(len(data))},
+		},
+		{
+			name:   "GET",
+			method: http.MethodGet,
+			status: http.StatusOK,
+			body:   data,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL+"/download", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, values := range tc.header {
+				req.Header[key] = values
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Fatalf("状态码 = %d, 期望 %d", resp.StatusCode, tc.status)
+			}
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("body长度 = %d, 期望 %d", len(body), len(tc.body))
+			}
+			for key, want := range tc.headers {
+				if got := resp.Header.Get(key); got != want {
+					t.Errorf("%s = %q, 期望 %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRangeResumeKeepsProfileProgress(t *testing.T) {
+	const target = 1 << 20
+	// 块大小为1KB，速率曲线在每块写入前按已发送字节数更新
+	rl := newTestRateLimit(t, &RateLimit{
+		PacingInterval: caddy.Duration(time.Millisecond),
+		Profile: &RateProfile{
+			RampDownAfterBytes: 8 * 1024,
+			RampDownRate:       target / 2,
+		},
+	})
+	name, data := newTestFile(t, 16*1024)
+
+	// 内部请求在响应发送完之后才记录速率，通过通道等待记录完成
+	rates := make(chan int64, 1)
+	srv := newTestFileServer(t, rl, name, http.Header{
+		"X-Accel-User-Id":   {"1"},
+		"X-Accel-Ratelimit": {strconv.Itoa(target)},
+	}, func(chain *BucketChain) {
+		rates <- chain.Limiter(ScopeTransfer).Rate()
+	})
+
+	get := func(rangeHeader string, want []byte) int64 {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/download", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(body, want) {
+			t.Fatalf("Range %q: body长度 = %d, %v; 期望 %d", rangeHeader, len(body), err, len(want))
+		}
+		return <-rates
+	}
+
+	// 第一次传输超过ramp_down_after_bytes后降速。续传的分段自身远未达到该大小，
+	// 但按整个传输计算仍应保持降速后的速率
+	got := []int64{get("", data), get("bytes=0-1023", data[:1024])}
+	// 传输过期后的Range请求开始新的传输，按目标速率发送
+	rl.transfers = newTransferRegistry()
+	got = append(got, get("bytes=0-1023", data[:1024]))
+
+	want := []int64{target / 2, target / 2, target}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("传输级令牌桶的速率 = %v, 期望 %v", got, want)
+	}
+}
+
+func TestAccelTargetOwnsResponse(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			// 后端的状态码和body都不能到达客户端，body也不能被嗅探出Content-Type。
+			// 后端显式设置的Content-Type等响应头按carry_headers的规则携带，这里不设置
+			w.Header().Set("X-Accel-Redirect", "/files/file.bin")
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, "backend-body")
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Range", "bytes 0-3/100")
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := io.WriteString(w, "FILE")
+		return err
+	})
+	srv := newTestServer(t, rl, next)
+
+	resp, err := http.Get(srv.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "FILE" {
+		t.Fatalf("状态码 %d, body %q; 期望 206 \"FILE\"", resp.StatusCode, body)
+	}
+	for key, want := range map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Range":  "bytes 0-3/100",
+		"Content-Length": "4",
+	} {
+		if got := resp.Header.Get(key); got != want {
+			t.Errorf("%s = %q, 期望 %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// 内部重定向时查询参数的处理方式
+const (
+	QueryReplace  = "replace"  // 只使用重定向URI中的查询参数，与nginx一致
+	QueryPreserve = "preserve" // 保留原始请求的查询参数，忽略重定向URI中的查询参数
+	QueryMerge    = "merge"    // 合并两者，同名参数以重定向URI中的为准
+)
+
+// namedLocation 判断重定向目标是否为nginx风格的命名位置（@name），返回位置名称
+func namedLocation(redirect string) (string, bool) {
+	return strings.CutPrefix(redirect, "@")
+}
+
+// namedRoute 返回命名位置对应的Caddy命名路由。没有配置映射时使用同名的命名路由，
+// 路由执行完毕后继续交给next处理，与invoke指令的行为一致
+func (rl *RateLimit) namedRoute(r *http.Request, location string, next caddyhttp.Handler) (caddyhttp.Handler, error) {
+	name := location
+	if mapped, ok := rl.NamedLocations[location]; ok {
+		name = mapped
+	}
+
+	srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	if !ok {
+		return nil, fmt.Errorf("无法获取当前服务器，不能执行命名位置 @%s", location)
+	}
+	route, ok := srv.NamedRoutes[name]
+	if !ok {
+		return nil, fmt.Errorf("命名位置 @%s 对应的命名路由 %s 不存在", location, name)
+	}
+	return route.Compile(next), nil
+}
+
+// redirectURL 解析重定向URI，生成内部请求的URL。路径保留原有的转义形式，
+// 查询参数按redirect_query的配置处理
+func (rl *RateLimit) redirectURL(r *http.Request, redirect string) (*url.URL, error) {
+	target, err := url.Parse(redirect)
+	if err != nil {
+		return nil, fmt.Errorf("无效的重定向URI %q: %v", redirect, err)
+	}
+	if target.Scheme != "" || target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		return nil, fmt.Errorf("重定向URI必须是以/开头的路径: %q", redirect)
+	}
+
+	cleaned, err := cleanRedirectPath(target)
+	if err != nil {
+		return nil, fmt.Errorf("拒绝重定向URI %q: %v", redirect, err)
+	}
+	if !rl.allowedRedirectPath(cleaned) {
+		return nil, fmt.Errorf("重定向URI %q 不在允许的前缀内", redirect)
+	}
+
+	u := *r.URL
+	u.Path = cleaned
+	u.RawPath = ""
+	if cleaned == target.Path {
+		u.RawPath = target.RawPath
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	switch rl.RedirectQuery {
+	case QueryPreserve:
+	case QueryMerge:
+		query := r.URL.Query()
+		for name, values := range target.Query() {
+			query[name] = values
+		}
+		u.RawQuery = query.Encode()
+	default:
+		u.RawQuery = target.RawQuery
+	}
+	return &u, nil
+}
+
+// cleanRedirectPath 规范化重定向路径。路径中不能包含..、编码的路径分隔符、
+// 反斜杠和NUL，这些都可能被用来访问受保护区域之外的文件
+func cleanRedirectPath(target *url.URL) (string, error) {
+	escaped := strings.ToLower(target.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+		return "", fmt.Errorf("路径包含编码的路径分隔符")
+	}
+	if strings.ContainsAny(target.Path, "\\\x00") {
+		return "", fmt.Errorf("路径包含反斜杠或NUL")
+	}
+	for _, segment := range strings.Split(target.Path, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("路径包含..")
+		}
+	}
+
+	cleaned := path.Clean(target.Path)
+	if strings.HasSuffix(target.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// allowedRedirectPath 判断规范化后的路径是否位于允许的前缀内，未配置前缀时允许所有路径
+func (rl *RateLimit) allowedRedirectPath(p string) bool {
+	if len(rl.AllowedPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range rl.AllowedPrefixes {
+		base := strings.TrimSuffix(prefix, "/")
+		if p == base || strings.HasPrefix(p, base+"/") {
+			return true
+		}
+	}
+	return false
+}
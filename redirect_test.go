@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestCleanRedirectPath(t *testing.T) {
+	tests := []struct {
+		path string // 转义形式的路径
+		want string // 为空表示应当拒绝
+	}{
+		{"/files/a.txt", "/files/a.txt"},
+		{"/files/dir/", "/files/dir/"},
+		{"/", "/"},
+		{"//a/./b", "/a/b"},
+		{"/a//b/./c/", "/a/b/c/"},
+		{"/files/%E4%B8%AD.txt", "/files/中.txt"},
+		{"/a/../b", ""},
+		{"/a/..", ""},
+		{"/a/%2e%2e/b", ""},
+		{"/a/%2E%2E/b", ""},
+		{"/a/%2Fb", ""},
+		{"/a/%2fb", ""},
+		{"/a/%5Cb", ""},
+		{"/a/%5cb", ""},
+		{`/a\b`, ""},
+		{`/a\..\b`, ""},
+		{"/a/%00b", ""},
+		{"/a/b%00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// 加上协议和主机再解析，避免//开头的路径被当作主机名
+			target, err := url.Parse("http://backend" + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cleanRedirectPath(target)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("cleanRedirectPath(%q) = %q, 期望拒绝", tt.path, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("cleanRedirectPath(%q) = %q, %v, 期望 %q", tt.path, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedRedirectPath(t *testing.T) {
+	rl := &RateLimit{AllowedPrefixes: []string{"/protected", "/media/"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/protected", true},
+		{"/protected/", true},
+		{"/protected/a.txt", true},
+		{"/protectedX", false},
+		{"/protectedX/a.txt", false},
+		{"/protected.bak/a.txt", false},
+		{"/media", true},
+		{"/media/a.mp4", true},
+		{"/mediafiles/a.mp4", false},
+		{"/", false},
+		{"/public/a.txt", false},
+	}
+	for _, tt := range tests {
+		if got := rl.allowedRedirectPath(tt.path); got != tt.want {
+			t.Errorf("allowedRedirectPath(%q) = %v, 期望 %v", tt.path, got, tt.want)
+		}
+	}
+
+	// 未配置前缀时允许所有路径
+	if !(&RateLimit{}).allowedRedirectPath("/anything") {
+		t.Error("未配置allowed_prefixes时拒绝了重定向")
+	}
+}
+
+func TestRejectedRedirectReturns502(t *testing.T) {
+	rl := newTestRateLimit(t, &RateLimit{AllowedPrefixes: []string{"/protected"}})
+
+	// 原始请求的查询参数redirect作为后端返回的X-Accel-Redirect，内部请求返回自己看到的路径
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if !IsInternalRedirect(r) {
+			w.Header().Set("X-Accel-Redirect", r.URL.Query().Get("redirect"))
+			return nil
+		}
+		_, err := w.Write([]byte(r.URL.Path))
+		return err
+	})
+	srv := newTestServer(t, rl, next)
+
+	tests := []struct {
+		redirect string
+		status   int
+		path     string
+	}{
+		{"/protected/a.txt", http.StatusOK, "/protected/a.txt"},
+		{"/protected//dir/./", http.StatusOK, "/protected/dir/"},
+		{"/protectedX/a.txt", http.StatusBadGateway, ""},
+		{"/public/a.txt", http.StatusBadGateway, ""},
+		{"/protected/../secret.txt", http.StatusBadGateway, ""},
+		{"/protected/%2e%2e/secret.txt", http.StatusBadGateway, ""},
+		{"/protected/..%2Fsecret.txt", http.StatusBadGateway, ""},
+		{"/protected/..%5Csecret.txt", http.StatusBadGateway, ""},
+		{"//backend/protected/a.txt", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.redirect, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + "/download?redirect=" + url.QueryEscape(tt.redirect))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("状态码 %d, 期望 %d", resp.StatusCode, tt.status)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.path {
+				t.Fatalf("内部请求的路径为 %q, 期望 %q", body, tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// 注册表的分片数量，必须是2的幂
+const registryShards = 64
+
+// registryShard 是注册表的一个分片，拥有独立的锁
+type registryShard struct {
+	buckets map[string]SharedLimiter
+	mutex   sync.RWMutex
+}
+
+// bucketRegistry 保存按键索引的共享限速器（用户、用户组等）。
+// 令牌桶按键的哈希分布在多个分片中，查找只锁定一个分片，
+// 清理也逐个分片进行，因此查找可以随CPU核数扩展，且不会被整表清理阻塞。
+type bucketRegistry struct {
+	seed   maphash.Seed
+	shards [registryShards]registryShard
+}
+
+// newBucketRegistry 创建新的令牌桶注册表
+func newBucketRegistry() *bucketRegistry {
+	br := &bucketRegistry{
+		seed: maphash.MakeSeed(),
+	}
+	for i := range br.shards {
+		br.shards[i].buckets = make(map[string]SharedLimiter)
+	}
+	return br
+}
+
+// shard 返回键所在的分片
+func (br *bucketRegistry) shard(key string) *registryShard {
+	return &br.shards[maphash.String(br.seed, key)&(registryShards-1)]
+}
+
+// get 获取指定键的令牌桶
+func (br *bucketRegistry) get(key string) (SharedLimiter, bool) {
+	shard := br.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	bucket, exists := shard.buckets[key]
+	return bucket, exists
+}
+
+// getOrCreate 获取指定键的令牌桶，不存在时使用create创建。
+// 第二个返回值表示令牌桶是否为新创建的。
+func (br *bucketRegistry) getOrCreate(key string, create func() SharedLimiter) (SharedLimiter, bool) {
+	if bucket, exists := br.get(key); exists {
+		return bucket, false
+	}
+
+	shard := br.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	// 双重检查，避免并发创建
+	if bucket, exists := shard.buckets[key]; exists {
+		return bucket, false
+	}
+
+	bucket := create()
+	shard.buckets[key] = bucket
+	return bucket, true
+}
+
+// sweep 删除超过maxIdle未访问的令牌桶，并对每个被删除的键调用onDelete
+func (br *bucketRegistry) sweep(maxIdle time.Duration, onDelete func(key string)) {
+	for i := range br.shards {
+		br.shards[i].sweep(maxIdle, onDelete)
+	}
+}
+
+// sweep 清理分片中的过期令牌桶。先在读锁下找出过期的键，
+// 只在删除时短暂持有写锁，避免扫描期间阻塞同一分片的查找
+func (shard *registryShard) sweep(maxIdle time.Duration, onDelete func(key string)) {
+	var expired []string
+	shard.mutex.RLock()
+	for key, bucket := range shard.buckets {
+		if time.Since(bucket.LastAccess()) > maxIdle {
+			expired = append(expired, key)
+		}
+	}
+	shard.mutex.RUnlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	shard.mutex.Lock()
+	for _, key := range expired {
+		// 扫描后令牌桶可能又被访问过，需要再次检查
+		if bucket, exists := shard.buckets[key]; exists && time.Since(bucket.LastAccess()) > maxIdle {
+			delete(shard.buckets, key)
+			if onDelete != nil {
+				onDelete(key)
+			}
+		}
+	}
+	shard.mutex.Unlock()
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// 限速传输等待令牌的方式
+const (
+	WaitSleep = "sleep" // 每次等待使用运行时定时器
+	WaitWheel = "wheel" // 由共享时间轮批量唤醒
+)
+
+// 共享时间轮的参数：每个tick 5ms，512个槽位，一圈约2.56秒，更长的等待按圈数计算
+const (
+	wheelTick  = 5 * time.Millisecond
+	wheelSlots = 512
+)
+
+// sharedWheel 是所有限速写入器共享的等待调度器
+var sharedWheel = newTimerWheel(wheelTick, wheelSlots)
+
+// wheelWaiter 是时间轮中的一个等待者
+type wheelWaiter struct {
+	ch     chan struct{}
+	rounds int // 还需要转过的整圈数
+}
+
+// timerWheel 是一个哈希时间轮。等待的写入器按唤醒时间放入槽位，
+// 由一个goroutine每个tick批量唤醒，代替每次等待各自创建定时器。
+// 唤醒按tick取整，平均延迟和每次等待的CPU都高于运行时定时器，
+// 只在约10万个并发等待时尾部延迟更低，因此需要通过wait_scheduler显式启用。
+// 没有等待者时goroutine会退出，下次有等待者时再启动。
+type timerWheel struct {
+	tick    time.Duration
+	slots   [][]*wheelWaiter
+	mutex   sync.Mutex
+	pos     int       // 当前所在槽位
+	ticks   int64     // 自启动以来已处理的tick数
+	started time.Time // goroutine启动时间
+	pending int       // 等待者数量
+	running bool
+}
+
+// newTimerWheel 创建新的时间轮
+func newTimerWheel(tick time.Duration, slots int) *timerWheel {
+	return &timerWheel{
+		tick:  tick,
+		slots: make([][]*wheelWaiter, slots),
+	}
+}
+
+// After 返回一个在大约d之后关闭的通道，精度为一个tick
+func (tw *timerWheel) After(d time.Duration) <-chan struct{} {
+	ticks := int((d + tw.tick - 1) / tw.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	waiter := &wheelWaiter{
+		ch:     make(chan struct{}),
+		rounds: (ticks - 1) / len(tw.slots),
+	}
+
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	slot := (tw.pos + ticks) % len(tw.slots)
+	tw.slots[slot] = append(tw.slots[slot], waiter)
+	tw.pending++
+
+	if !tw.running {
+		tw.running = true
+		tw.started = time.Now()
+		tw.ticks = 0
+		go tw.run()
+	}
+	return waiter.ch
+}
+
+// Sleep 阻塞大约d的时间
+func (tw *timerWheel) Sleep(d time.Duration) {
+	<-tw.After(d)
+}
+
+// run 按tick推进时间轮，直到没有等待者
+func (tw *timerWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	var expired []chan struct{}
+	for now := range ticker.C {
+		var running bool
+		expired, running = tw.advance(now, expired[:0])
+		// 在锁外唤醒，被唤醒的写入器再次等待时不会与时间轮争抢锁
+		for i, ch := range expired {
+			close(ch)
+			expired[i] = nil
+		}
+		if !running {
+			return
+		}
+	}
+}
+
+// advance 处理截至now应当经过的所有tick，将到期等待者的通道追加到expired后返回，
+// 并返回是否还有等待者。按实际经过的时间推进，goroutine被延迟调度时不会累积误差
+func (tw *timerWheel) advance(now time.Time, expired []chan struct{}) ([]chan struct{}, bool) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	target := int64(now.Sub(tw.started) / tw.tick)
+	for tw.ticks < target {
+		tw.ticks++
+		tw.pos = (tw.pos + 1) % len(tw.slots)
+
+		waiters := tw.slots[tw.pos]
+		remaining := waiters[:0]
+		for _, waiter := range waiters {
+			if waiter.rounds > 0 {
+				waiter.rounds--
+				remaining = append(remaining, waiter)
+				continue
+			}
+			expired = append(expired, waiter.ch)
+			tw.pending--
+		}
+		clear(waiters[len(remaining):])
+		tw.slots[tw.pos] = remaining
+	}
+
+	if tw.pending == 0 {
+		tw.running = false
+		return expired, false
+	}
+	return expired, true
+}
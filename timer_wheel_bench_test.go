@@ -0,0 +1,62 @@
+//go:build unix
+
+package ratelimit
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkConcurrentSleep 比较共享时间轮和time.Sleep在大量并发等待时的CPU消耗和唤醒精度。
+// 每个goroutine模拟一个限速写入器，循环等待10ms到60ms不等的时间；
+// 报告每次等待消耗的CPU，以及实际唤醒时间相对于请求时间的平均和p99偏差
+func BenchmarkConcurrentSleep(b *testing.B) {
+	sleepers := map[string]func(time.Duration){
+		"wheel": sharedWheel.Sleep,
+		"timer": time.Sleep,
+	}
+	for _, n := range []int{10000, 100000} {
+		for _, name := range []string{"wheel", "timer"} {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				sleep := sleepers[name]
+				late := make([][]time.Duration, n)
+				var wg sync.WaitGroup
+				start := make(chan struct{})
+				for i := range late {
+					late[i] = make([]time.Duration, 0, b.N)
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						d := 10*time.Millisecond + time.Duration(i%50)*time.Millisecond
+						<-start
+						for j := 0; j < b.N; j++ {
+							begin := time.Now()
+							sleep(d)
+							late[i] = append(late[i], time.Since(begin)-d)
+						}
+					}(i)
+				}
+
+				b.ResetTimer()
+				cpu := processCPUTime(b)
+				close(start)
+				wg.Wait()
+				cpu = processCPUTime(b) - cpu
+				b.StopTimer()
+
+				all := slices.Concat(late...)
+				slices.Sort(all)
+				var sum time.Duration
+				for _, d := range all {
+					sum += d
+				}
+				b.ReportMetric(float64(cpu.Nanoseconds())/float64(len(all))/1e3, "cpu-µs/wait")
+				b.ReportMetric(float64(sum.Microseconds())/float64(len(all)), "late-µs")
+				b.ReportMetric(float64(all[len(all)*99/100].Microseconds()), "p99-late-µs")
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newManualWheel 创建不启动后台goroutine的时间轮，由测试调用advance逐个tick推进
+func newManualWheel(slots int) *timerWheel {
+	tw := newTimerWheel(time.Millisecond, slots)
+	tw.running = true
+	tw.started = time.Unix(0, 0)
+	return tw
+}
+
+// advanceTo 将时间轮推进到now并唤醒到期的等待者，返回是否还有等待者
+func advanceTo(tw *timerWheel, now time.Time) bool {
+	expired, running := tw.advance(now, nil)
+	for _, ch := range expired {
+		close(ch)
+	}
+	return running
+}
+
+// step 将时间轮推进一个tick
+func step(tw *timerWheel) bool {
+	return advanceTo(tw, tw.started.Add(time.Duration(tw.ticks+1)*tw.tick))
+}
+
+// closed 返回通道是否已关闭
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTimerWheelSlotsAndRounds(t *testing.T) {
+	const slots = 8
+	tick := time.Millisecond
+
+	for _, tc := range []struct {
+		name  string
+		start int           // 加入等待者前时间轮已经推进的tick数
+		d     time.Duration // 等待时间
+		fire  int           // 期望在加入后第几个tick唤醒
+	}{
+		{"零", 0, 0, 1},
+		{"不足一个tick", 0, tick / 2, 1},
+		{"一个tick", 0, tick, 1},
+		{"向上取整", 0, tick + 1, 2},
+		{"一圈内", 0, 5 * tick, 5},
+		{"正好一圈", 0, slots * tick, slots},
+		{"一圈多一个tick", 0, (slots + 1) * tick, slots + 1},
+		{"两圈", 0, 2 * slots * tick, 2 * slots},
+		{"跨过末尾槽位", 6, 3 * tick, 3},
+		{"跨过末尾槽位且多圈", 5, (2*slots + 4) * tick, 2*slots + 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tw := newManualWheel(slots)
+			// 推进时需要一个等待者让时间轮保持运行
+			keep := tw.After(time.Hour)
+			for i := 0; i < tc.start; i++ {
+				step(tw)
+			}
+
+			ch := tw.After(tc.d)
+			// 等待者放在 (pos+ticks)%slots 槽位，圈数为 (ticks-1)/slots
+			slot := tw.slots[(tw.pos+tc.fire)%slots]
+			if len(slot) == 0 || slot[len(slot)-1].ch != ch {
+				t.Fatalf("等待者不在第 %d 个槽位", (tw.pos+tc.fire)%slots)
+			}
+			if rounds, want := slot[len(slot)-1].rounds, (tc.fire-1)/slots; rounds != want {
+				t.Fatalf("圈数 = %d, 期望 %d", rounds, want)
+			}
+			for i := 1; i <= tc.fire; i++ {
+				step(tw)
+				if closed(ch) != (i == tc.fire) {
+					t.Fatalf("第 %d 个tick时唤醒状态为 %v，期望在第 %d 个tick唤醒", i, closed(ch), tc.fire)
+				}
+			}
+			if closed(keep) {
+				t.Fatal("较长的等待者被提前唤醒")
+			}
+			if tw.pending != 1 {
+				t.Fatalf("剩余等待者 = %d, 期望 1", tw.pending)
+			}
+		})
+	}
+}
+
+func TestTimerWheelStopsWhenIdle(t *testing.T) {
+	tw := newManualWheel(4)
+	a := tw.After(time.Millisecond)
+	b := tw.After(6 * time.Millisecond)
+
+	// 多个tick一起到期时一次advance全部处理
+	if !advanceTo(tw, tw.started.Add(2*time.Millisecond)) {
+		t.Fatal("还有等待者时时间轮停止了")
+	}
+	if !closed(a) || closed(b) {
+		t.Fatal("唤醒顺序不正确")
+	}
+	if advanceTo(tw, tw.started.Add(6*time.Millisecond)) {
+		t.Fatal("没有等待者时时间轮没有停止")
+	}
+	if !closed(b) || tw.running || tw.pending != 0 {
+		t.Fatalf("closed %v, running %v, pending %d", closed(b), tw.running, tw.pending)
+	}
+}
+
+func TestTimerWheelAccuracy(t *testing.T) {
+	tw := newTimerWheel(wheelTick, wheelSlots)
+	for _, d := range []time.Duration{wheelTick, 20 * time.Millisecond, 100 * time.Millisecond} {
+		start := time.Now()
+		tw.Sleep(d)
+		elapsed := time.Since(start)
+		// 当前tick已经过去的部分也计入等待，因此最多提前一个tick
+		if elapsed < d-wheelTick || elapsed > d+10*wheelTick {
+			t.Errorf("Sleep(%v) 实际等待 %v", d, elapsed)
+		}
+	}
+}
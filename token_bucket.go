@@ -17,6 +17,7 @@ type TokenBucket struct {
 	userID         string        // 用户ID
 	logger         *zap.Logger   // 日志记录器
 	burstMultiplier float64      // 突发倍数
+	burst          int64         // 突发容量（字节），大于0时代替突发倍数
 	lastStorageUpdate time.Time  // 上次存储更新时间
 }
 
@@ -61,19 +62,7 @@ func (tb *TokenBucket) Allow(count int64) bool {
 	tb.mutex.Lock()
 	defer tb.mutex.Unlock()
 
-	now := time.Now()
-	elapsed := now.Sub(tb.lastAccess).Seconds()
-	tb.lastAccess = now
-
-	// 根据经过的时间，添加新的令牌
-	newTokens := float64(tb.rate) * elapsed
-	tb.tokens += newTokens
-
-	// 令牌数量上限为速率的burstMultiplier倍
-	maxTokens := float64(tb.rate) * tb.burstMultiplier
-	if tb.tokens > maxTokens {
-		tb.tokens = maxTokens
-	}
+	elapsed, newTokens, maxTokens := tb.refill(time.Now())
 
 	// 使用条件日志并减少日志频率
 	shouldLog := tb.logger.Core().Enabled(zapcore.DebugLevel) && 
@@ -121,6 +110,59 @@ func (tb *TokenBucket) Allow(count int64) bool {
 	return true
 }
 
+// Consume 强制消耗指定数量的令牌，不检查余量，令牌数可以变为负数，
+// 但欠债不超过一个突发容量。count 为负数时表示归还令牌。
+func (tb *TokenBucket) Consume(count int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	_, _, maxTokens := tb.refill(time.Now())
+	tb.tokens -= float64(count)
+	if tb.tokens > maxTokens {
+		tb.tokens = maxTokens
+	} else if tb.tokens < -maxTokens {
+		tb.tokens = -maxTokens
+	}
+}
+
+// Delay 返回获得指定数量令牌还需等待的时间，令牌充足时返回0
+func (tb *TokenBucket) Delay(count int64) time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill(time.Now())
+	missing := float64(count) - tb.tokens
+	if missing <= 0 {
+		return 0
+	}
+
+	rate := tb.rate
+	if rate <= 0 {
+		rate = 1024 // 默认1KB/s
+	}
+	return time.Duration(missing / float64(rate) * float64(time.Second))
+}
+
+// refill 根据经过的时间补充令牌，调用者必须持有写锁
+func (tb *TokenBucket) refill(now time.Time) (elapsed, newTokens, maxTokens float64) {
+	elapsed = now.Sub(tb.lastAccess).Seconds()
+	tb.lastAccess = now
+
+	// 根据经过的时间，添加新的令牌
+	newTokens = float64(tb.rate) * elapsed
+	tb.tokens += newTokens
+
+	// 令牌数量上限为突发容量，未设置时为速率的burstMultiplier倍
+	maxTokens = float64(tb.rate) * tb.burstMultiplier
+	if tb.burst > 0 {
+		maxTokens = float64(tb.burst)
+	}
+	if tb.tokens > maxTokens {
+		tb.tokens = maxTokens
+	}
+	return elapsed, newTokens, maxTokens
+}
+
 // Rate 获取令牌桶的速率
 func (tb *TokenBucket) Rate() int64 {
 	tb.mutex.RLock()
@@ -135,6 +177,23 @@ func (tb *TokenBucket) SetRate(rate int64) {
 	tb.rate = rate
 }
 
+// Burst 返回令牌桶的最大令牌数
+func (tb *TokenBucket) Burst() int64 {
+	tb.mutex.RLock()
+	defer tb.mutex.RUnlock()
+	if tb.burst > 0 {
+		return tb.burst
+	}
+	return int64(float64(tb.rate) * tb.burstMultiplier)
+}
+
+// SetBurst 设置令牌桶的突发容量（字节），0表示使用突发倍数
+func (tb *TokenBucket) SetBurst(burst int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.burst = burst
+}
+
 // LastAccess 获取最后访问时间
 func (tb *TokenBucket) LastAccess() time.Time {
 	tb.mutex.RLock()
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"hash/maphash"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认保留单次传输令牌桶的时间
+const defaultTransferResumeTTL = 10 * time.Minute
+
+// transferState 是同一次传输在多个Range请求之间共享的状态。
+// 速率曲线按整个传输而不是单个响应计算，续传或并行分段不会重新开始爬升，
+// 也不能通过重新连接绕过降速
+type transferState struct {
+	bucket *AtomicTokenBucket
+	start  time.Time    // 第一次请求的开始时间
+	target atomic.Int64 // 速率曲线的目标速率
+	sent   atomic.Int64 // 所有分段已发送的字节数
+}
+
+// newTransferState 创建以bucket的当前速率为目标速率的传输状态
+func newTransferState(bucket *AtomicTokenBucket) *transferState {
+	state := &transferState{
+		bucket: bucket,
+		start:  time.Now(),
+	}
+	state.target.Store(bucket.Rate())
+	return state
+}
+
+// applyProfile 按传输的总进度计算速率并更新令牌桶，
+// 同一传输的各个分段得到的速率相同，不会互相覆盖
+func (ts *transferState) applyProfile(profile *RateProfile) {
+	rate := profile.RateAt(ts.target.Load(), time.Since(ts.start), ts.sent.Load())
+	if rate != ts.bucket.Rate() {
+		ts.bucket.SetRate(rate)
+	}
+}
+
+// transferShard 是传输注册表的一个分片
+type transferShard struct {
+	transfers map[string]*transferState
+	mutex     sync.Mutex
+}
+
+// transferRegistry 保存最近的单次传输状态，按用户和文件索引。
+// 客户端断开后用Range请求续传同一个文件时沿用原来的令牌桶，
+// 不能通过重新连接重新获得突发容量。分片方式与bucketRegistry相同
+type transferRegistry struct {
+	seed   maphash.Seed
+	shards [registryShards]transferShard
+}
+
+// newTransferRegistry 创建新的传输注册表
+func newTransferRegistry() *transferRegistry {
+	tr := &transferRegistry{
+		seed: maphash.MakeSeed(),
+	}
+	for i := range tr.shards {
+		tr.shards[i].transfers = make(map[string]*transferState)
+	}
+	return tr
+}
+
+// shard 返回键所在的分片
+func (tr *transferRegistry) shard(key string) *transferShard {
+	return &tr.shards[maphash.String(tr.seed, key)&(registryShards-1)]
+}
+
+// get 获取指定键的传输状态，令牌桶空闲超过ttl的传输视为不存在
+func (tr *transferRegistry) get(key string, ttl time.Duration) (*transferState, bool) {
+	shard := tr.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	state, exists := shard.transfers[key]
+	if !exists || state.bucket.Idle() > ttl {
+		return nil, false
+	}
+	return state, true
+}
+
+// put 保存指定键的传输状态，替换已有的传输
+func (tr *transferRegistry) put(key string, state *transferState) {
+	shard := tr.shard(key)
+	shard.mutex.Lock()
+	shard.transfers[key] = state
+	shard.mutex.Unlock()
+}
+
+// sweep 删除令牌桶空闲超过ttl的传输
+func (tr *transferRegistry) sweep(ttl time.Duration) {
+	for i := range tr.shards {
+		shard := &tr.shards[i]
+		shard.mutex.Lock()
+		for key, state := range shard.transfers {
+			if state.bucket.Idle() > ttl {
+				delete(shard.transfers, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// transfer 返回单次传输的状态。Range请求续传同一用户的同一个文件时
+// 沿用上一次传输的令牌桶、开始时间和已发送字节数，并按本次响应头更新目标速率；
+// 其他请求创建新的传输
+func (rl *RateLimit) transfer(r *http.Request, header http.Header, target string, rate int64) *transferState {
+	key := rl.transferKey(r, header, target)
+	if r.Header.Get("Range") != "" {
+		if state, ok := rl.transfers.get(key, time.Duration(rl.TransferResumeTTL)); ok {
+			state.target.Store(rate)
+			// 启用速率曲线时由写入器按传输进度设置速率，这里直接设置会让并行的分段重新爬升
+			if rl.Profile == nil && state.bucket.Rate() != rate {
+				state.bucket.SetRate(rate)
+			}
+			return state
+		}
+	}
+
+	state := newTransferState(NewAtomicTokenBucket(rate, rl.TransferBurstMultiplier))
+	rl.transfers.put(key, state)
+	return state
+}
+
+// transferKey 返回传输注册表的键，由用户ID（没有时使用客户端IP）和内部重定向的路径组成
+func (rl *RateLimit) transferKey(r *http.Request, header http.Header, target string) string {
+	identity := header.Get(rl.HeaderUserID)
+	if identity == "" {
+		identity = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			identity = host
+		}
+	}
+	return ScopeTransfer + ":" + identity + ":" + target
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(XAccel{})
+	httpcaddyfile.RegisterHandlerDirective("x_accel", parseXAccelCaddyfile)
+	// 与 reverse_proxy 处于相同的位置
+	httpcaddyfile.RegisterDirectiveOrder("x_accel", httpcaddyfile.Before, "reverse_proxy")
+}
+
+// XAccel 把完整的X-Accel流程封装为一个处理器：请求先交给upstream（通常是反向代理），
+// 后端返回X-Accel响应时，内部请求交给serve处理，并按响应头限速。
+// 不需要再手动组合rate_limit_dynamic、intercept、rewrite、method和rate_limit_interceptor，
+// 这些处理器仍然保留用于更复杂的配置。
+type XAccel struct {
+	RateLimit
+
+	// 处理原始请求的处理器，通常是reverse_proxy或包含它的subroute
+	UpstreamRaw json.RawMessage `json:"upstream,omitempty" caddy:"namespace=http.handlers inline_key=handler"`
+
+	// 处理内部重定向请求的处理器，默认为file_server
+	ServeRaw json.RawMessage `json:"serve,omitempty" caddy:"namespace=http.handlers inline_key=handler"`
+
+	upstream    caddyhttp.MiddlewareHandler
+	serve       caddyhttp.MiddlewareHandler
+	interceptor *RateLimitInterceptor
+}
+
+// CaddyModule 返回Caddy模块信息
+func (XAccel) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.x_accel",
+		New: func() caddy.Module { return new(XAccel) },
+	}
+}
+
+// Provision 实现caddy.Provisioner接口
+func (x *XAccel) Provision(ctx caddy.Context) error {
+	if err := x.RateLimit.Provision(ctx); err != nil {
+		return err
+	}
+	x.interceptor = &RateLimitInterceptor{logger: x.logger}
+
+	if x.UpstreamRaw == nil {
+		return fmt.Errorf("x_accel必须指定upstream")
+	}
+	mod, err := ctx.LoadModule(x, "UpstreamRaw")
+	if err != nil {
+		return fmt.Errorf("加载upstream失败: %v", err)
+	}
+	x.upstream = mod.(caddyhttp.MiddlewareHandler)
+
+	if x.ServeRaw == nil {
+		x.ServeRaw = json.RawMessage(`{"handler":"file_server"}`)
+	}
+	mod, err = ctx.LoadModule(x, "ServeRaw")
+	if err != nil {
+		return fmt.Errorf("加载serve失败: %v", err)
+	}
+	x.serve = mod.(caddyhttp.MiddlewareHandler)
+	return nil
+}
+
+// ServeHTTP 实现caddyhttp.MiddlewareHandler接口
+func (x *XAccel) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return x.upstream.ServeHTTP(w, r, next)
+	})
+	serve := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return x.serve.ServeHTTP(w, r, next)
+	})
+	target := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return x.interceptor.ServeHTTP(w, r, serve)
+	})
+	return x.serveAccel(w, r, upstream, target)
+}
+
+// parseXAccelCaddyfile 解析 x_accel 指令
+//
+//	x_accel [<upstreams...>] {
+//	    upstream {
+//	        reverse_proxy ...
+//	    }
+//	    serve {
+//	        file_server ...
+//	    }
+//	    # 其他子指令与 rate_limit_dynamic 相同
+//	}
+//
+// 指令行的参数是反向代理的上游地址，与upstream块只能二选一。
+// 没有serve块时使用file_server
+func parseXAccelCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	x := new(XAccel)
+	var warnings []caddyconfig.Warning
+
+	h.Next() // 跳过指令名
+	if upstreams := h.RemainingArgs(); len(upstreams) > 0 {
+		proxy, err := parseUpstreams(h, upstreams)
+		if err != nil {
+			return nil, err
+		}
+		x.UpstreamRaw = caddyconfig.JSONModuleObject(proxy, "handler", "reverse_proxy", &warnings)
+	}
+
+	for h.NextBlock(0) {
+		switch h.Val() {
+		case "upstream", "serve":
+			name := h.Val()
+			handler, err := httpcaddyfile.ParseSegmentAsSubroute(h.WithDispenser(h.NewFromNextSegment()))
+			if err != nil {
+				return nil, err
+			}
+			raw := caddyconfig.JSONModuleObject(handler, "handler", "subroute", &warnings)
+			if name == "serve" {
+				x.ServeRaw = raw
+				continue
+			}
+			if x.UpstreamRaw != nil {
+				return nil, h.Err("上游地址和upstream块只能指定一个")
+			}
+			x.UpstreamRaw = raw
+		default:
+			if err := x.RateLimit.unmarshalOption(h.Dispenser); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if x.UpstreamRaw == nil {
+		return nil, h.Err("x_accel必须指定上游地址或upstream块")
+	}
+	return x, nil
+}
+
+// parseUpstreams 用指令行的上游地址构建反向代理，等同于 reverse_proxy <upstreams...>
+func parseUpstreams(h httpcaddyfile.Helper, upstreams []string) (*reverseproxy.Handler, error) {
+	tokens := []caddyfile.Token{{File: h.File(), Line: h.Line(), Text: "reverse_proxy"}}
+	for _, upstream := range upstreams {
+		tokens = append(tokens, caddyfile.Token{File: h.File(), Line: h.Line(), Text: upstream})
+	}
+
+	proxy := new(reverseproxy.Handler)
+	if err := proxy.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens)); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*XAccel)(nil)
+	_ caddy.CleanerUpper          = (*XAccel)(nil)
+	_ caddy.Validator             = (*XAccel)(nil)
+	_ caddyhttp.MiddlewareHandler = (*XAccel)(nil)
+)